@@ -5,7 +5,17 @@
 package netipx
 
 import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/big"
+	"math/rand"
 	"net/netip"
 	"runtime"
 	"sort"
@@ -21,6 +31,11 @@ import (
 // general Adds should be called first. Input ranges may overlap in
 // any way.
 //
+// IPv4 addresses and IPv4-mapped IPv6 addresses (such as
+// ::ffff:1.2.3.4) are distinct, so adding one does not make the other
+// a member of the set. Use netip.Addr.Unmap on addresses of unknown
+// origin before adding them to get consistent IPv4 membership.
+//
 // Most IPSetBuilder methods do not return errors.
 // Instead, errors are accumulated and reported by IPSetBuilder.IPSet.
 type IPSetBuilder struct {
@@ -169,6 +184,44 @@ func (s *IPSetBuilder) Clone() *IPSetBuilder {
 	}
 }
 
+// Compact normalizes s and reallocates its internal storage to fit,
+// releasing memory held over from earlier, larger states of s. It
+// does not change the set of IPs in s.
+//
+// IPSets returned by IPSet do not share storage with s, so Compact is
+// only useful for long-lived builders.
+func (s *IPSetBuilder) Compact() {
+	s.normalize()
+	s.in = append([]IPRange(nil), s.in...)
+	s.out = append([]IPRange(nil), s.out...)
+}
+
+// Clear removes all IPs and accumulated errors from s, keeping its
+// internal storage for reuse by subsequent Add and Remove calls.
+func (s *IPSetBuilder) Clear() {
+	s.in = s.in[:0]
+	s.out = s.out[:0]
+	s.errs = nil
+}
+
+// Grow grows s's internal storage, if necessary, to hold another n
+// added ranges, prefixes or IPs without reallocating. It is a
+// performance hint for bulk loading and does not change the set of IPs
+// in s. An add following a removal normalizes s, which may discard the
+// extra storage.
+//
+// Grow panics if n is negative.
+func (s *IPSetBuilder) Grow(n int) {
+	if n < 0 {
+		panic("negative IPSetBuilder.Grow count")
+	}
+	if len(s.in)+n > cap(s.in) {
+		in := make([]IPRange, len(s.in), len(s.in)+n)
+		copy(in, s.in)
+		s.in = in
+	}
+}
+
 func (s *IPSetBuilder) addError(msg string, args ...interface{}) {
 	se := new(stacktraceErr)
 	// Skip three frames: runtime.Callers, addError, and the IPSetBuilder
@@ -182,6 +235,7 @@ func (s *IPSetBuilder) addError(msg string, args ...interface{}) {
 }
 
 // Add adds ip to s.
+// Any IPv6 zone on ip is dropped, because IPSets do not track zones.
 func (s *IPSetBuilder) Add(ip netip.Addr) {
 	if !ip.IsValid() {
 		s.addError("Add(IP{})")
@@ -190,6 +244,23 @@ func (s *IPSetBuilder) Add(ip netip.Addr) {
 	s.AddRange(IPRangeFrom(ip, ip))
 }
 
+// AddIPs adds all of ips to s.
+// It is equivalent to calling Add for each IP but normalizes s at most
+// once and grows it in a single allocation.
+func (s *IPSetBuilder) AddIPs(ips []netip.Addr) {
+	if len(s.out) > 0 {
+		s.normalize()
+	}
+	s.Grow(len(ips))
+	for _, ip := range ips {
+		if !ip.IsValid() {
+			s.addError("Add(IP{})")
+			continue
+		}
+		s.in = append(s.in, IPRangeFrom(ip, ip))
+	}
+}
+
 // AddPrefix adds all IPs in p to s.
 func (s *IPSetBuilder) AddPrefix(p netip.Prefix) {
 	if r := RangeOfPrefix(p); r.IsValid() {
@@ -199,6 +270,18 @@ func (s *IPSetBuilder) AddPrefix(p netip.Prefix) {
 	}
 }
 
+// AddPrefixString parses cidr as a prefix and adds all its IPs to s.
+// Unlike most IPSetBuilder methods, it returns any parse error
+// directly, leaving s unchanged.
+func (s *IPSetBuilder) AddPrefixString(cidr string) error {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return err
+	}
+	s.AddPrefix(p)
+	return nil
+}
+
 // AddRange adds r to s.
 // If r is not Valid, AddRange does nothing.
 func (s *IPSetBuilder) AddRange(r IPRange) {
@@ -233,6 +316,23 @@ func (s *IPSetBuilder) Remove(ip netip.Addr) {
 	}
 }
 
+// RemoveIPs removes all of ips from s.
+// It is equivalent to calling Remove for each IP.
+func (s *IPSetBuilder) RemoveIPs(ips []netip.Addr) {
+	if n := len(s.out) + len(ips); n > cap(s.out) {
+		out := make([]IPRange, len(s.out), n)
+		copy(out, s.out)
+		s.out = out
+	}
+	for _, ip := range ips {
+		if !ip.IsValid() {
+			s.addError("Remove(IP{})")
+			continue
+		}
+		s.out = append(s.out, IPRangeFrom(ip, ip))
+	}
+}
+
 // RemovePrefix removes all IPs in p from s.
 func (s *IPSetBuilder) RemovePrefix(p netip.Prefix) {
 	if r := RangeOfPrefix(p); r.IsValid() {
@@ -242,6 +342,18 @@ func (s *IPSetBuilder) RemovePrefix(p netip.Prefix) {
 	}
 }
 
+// RemovePrefixString parses cidr as a prefix and removes all its IPs
+// from s. Unlike most IPSetBuilder methods, it returns any parse error
+// directly, leaving s unchanged.
+func (s *IPSetBuilder) RemovePrefixString(cidr string) error {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return err
+	}
+	s.RemovePrefix(p)
+	return nil
+}
+
 // RemoveRange removes all IPs in r from s.
 func (s *IPSetBuilder) RemoveRange(r IPRange) {
 	if r.IsValid() {
@@ -319,6 +431,149 @@ func (s *IPSetBuilder) IPSet() (*IPSet, error) {
 	}
 }
 
+// Rule is an allow or deny rule for a prefix, as used by
+// BuildFromRules.
+type Rule struct {
+	// Allow is whether the IPs in Prefix are added to the set
+	// (true) or removed from it (false).
+	Allow bool
+
+	// Prefix is the prefix the rule applies to.
+	Prefix netip.Prefix
+}
+
+// BuildFromRules returns the IPSet of IPs allowed by applying rules in
+// order, starting from an empty set: an allow rule adds its prefix to
+// the set, and a deny rule removes it. Later rules thus override
+// earlier ones.
+//
+// Like IPSetBuilder.IPSet, BuildFromRules skips rules with invalid
+// prefixes and reports them in the returned error.
+func BuildFromRules(rules []Rule) (*IPSet, error) {
+	var b IPSetBuilder
+	for _, r := range rules {
+		if r.Allow {
+			b.AddPrefix(r.Prefix)
+		} else {
+			b.RemovePrefix(r.Prefix)
+		}
+	}
+	return b.IPSet()
+}
+
+// ParseIPSet returns the IPSet of all IPs in cidrs. Each entry is
+// either a prefix such as "10.0.0.0/8" or a range of two IPs
+// separated by a hyphen, as accepted by ParseIPRangeOrPrefix.
+//
+// It returns an error identifying the first malformed entry.
+func ParseIPSet(cidrs ...string) (*IPSet, error) {
+	var b IPSetBuilder
+	for i, s := range cidrs {
+		r, err := ParseIPRangeOrPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		b.AddRange(r)
+	}
+	return b.IPSet()
+}
+
+// ParseIPSetFromReader returns the IPSet of all IPs listed in r, one
+// entry per line. Each entry is a prefix or range, as accepted by
+// ParseIPSet. Blank lines and text following a '#' are ignored.
+//
+// It returns an error identifying the line number of the first
+// malformed entry.
+func ParseIPSetFromReader(r io.Reader) (*IPSet, error) {
+	var b IPSetBuilder
+	if _, err := b.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return b.IPSet()
+}
+
+// ReadFrom implements io.ReaderFrom. It adds the IPs listed in r to s,
+// in the format accepted by ParseIPSetFromReader, and returns the
+// number of bytes read.
+//
+// If a line is malformed, ReadFrom returns an error identifying its
+// line number. Entries on earlier lines have already been added to s.
+func (s *IPSetBuilder) ReadFrom(r io.Reader) (n int64, err error) {
+	cr := &countingReader{r: r}
+	sc := bufio.NewScanner(cr)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if i := strings.IndexByte(text, '#'); i != -1 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		ipr, err := ParseIPRangeOrPrefix(text)
+		if err != nil {
+			return cr.n, fmt.Errorf("line %d: %w", line, err)
+		}
+		s.AddRange(ipr)
+	}
+	return cr.n, sc.Err()
+}
+
+// countingReader is an io.Reader that counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// ParseIPSetCSV returns the IPSet of all IPs in the CSV data read from
+// r. Each row has two fields, the first and last IP of a range. If
+// neither field of the first row is an IP, that row is treated as a
+// header and skipped.
+//
+// It returns an error identifying the row number of the first
+// malformed row.
+func ParseIPSetCSV(r io.Reader) (*IPSet, error) {
+	var b IPSetBuilder
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	for row := 1; ; row++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) != 2 {
+			return nil, fmt.Errorf("row %d: got %d fields, want 2", row, len(rec))
+		}
+		from, fromErr := netip.ParseAddr(rec[0])
+		to, toErr := netip.ParseAddr(rec[1])
+		if row == 1 && fromErr != nil && toErr != nil {
+			continue // header
+		}
+		if fromErr != nil {
+			return nil, fmt.Errorf("row %d: invalid From IP %q", row, rec[0])
+		}
+		if toErr != nil {
+			return nil, fmt.Errorf("row %d: invalid To IP %q", row, rec[1])
+		}
+		ipr := IPRangeFrom(from, to)
+		if !ipr.IsValid() {
+			return nil, fmt.Errorf("row %d: range %v to %v not valid", row, from, to)
+		}
+		b.AddRange(ipr)
+	}
+	return b.IPSet()
+}
+
 // IPSet represents a set of IP addresses.
 //
 // IPSet is safe for concurrent use.
@@ -335,20 +590,408 @@ type IPSet struct {
 
 // Ranges returns the minimum and sorted set of IP
 // ranges that covers s.
+//
+// Ranges necessarily allocates. See AppendRanges for a version that
+// uses memory you provide.
 func (s *IPSet) Ranges() []IPRange {
-	return append([]IPRange{}, s.rr...)
+	return s.AppendRanges(make([]IPRange, 0, len(s.rr)))
+}
+
+// AppendRanges is an append version of IPSet.Ranges. It appends the
+// minimum and sorted set of IP ranges that covers s to dst.
+func (s *IPSet) AppendRanges(dst []IPRange) []IPRange {
+	return append(dst, s.rr...)
+}
+
+// NumRanges returns the number of ranges Ranges would return, without
+// allocating.
+func (s *IPSet) NumRanges() int {
+	return len(s.rr)
+}
+
+// ForEachRange calls f for each of the ranges Ranges would return, in
+// order, without allocating. It stops early if f returns false.
+func (s *IPSet) ForEachRange(f func(IPRange) bool) {
+	for _, r := range s.rr {
+		if !f(r) {
+			return
+		}
+	}
+}
+
+// RangesReverse returns the same ranges as Ranges, in descending
+// order.
+func (s *IPSet) RangesReverse() []IPRange {
+	out := make([]IPRange, len(s.rr))
+	for i, r := range s.rr {
+		out[len(out)-1-i] = r
+	}
+	return out
+}
+
+// CoalesceWithin returns the sorted ranges of s, with ranges of the
+// same address family merged when at most gap addresses lie between
+// them. The result may therefore cover IPs not in s; it is meant for
+// coarse views such as visualization. With gap 0 it is equivalent to
+// Ranges.
+func (s *IPSet) CoalesceWithin(gap uint64) []IPRange {
+	out := make([]IPRange, 0, len(s.rr))
+	for _, r := range s.rr {
+		if len(out) > 0 {
+			last := &out[len(out)-1]
+			if last.to.Is4() == r.from.Is4() {
+				between := u128From16(r.from.As16()).sub(u128From16(last.to.As16())).subOne()
+				if between.hi == 0 && between.lo <= gap {
+					last.to = r.to
+					continue
+				}
+			}
+		}
+		out = append(out, r)
+	}
+	return out
 }
 
 // Prefixes returns the minimum and sorted set of IP prefixes
-// that covers s.
+// that covers s. No returned prefix overlaps another.
+//
+// Prefixes necessarily allocates. See AppendPrefixes for a version that
+// uses memory you provide.
 func (s *IPSet) Prefixes() []netip.Prefix {
+	return s.AppendPrefixes(make([]netip.Prefix, 0, len(s.rr)))
+}
+
+// AppendPrefixes is an append version of IPSet.Prefixes. It appends the
+// minimum and sorted set of IP prefixes that covers s to dst.
+func (s *IPSet) AppendPrefixes(dst []netip.Prefix) []netip.Prefix {
+	for _, r := range s.rr {
+		dst = r.AppendPrefixes(dst)
+	}
+	return dst
+}
+
+// PrefixesIn returns the minimum and sorted set of IP prefixes that
+// covers the IPs of s within bounds.
+//
+// It returns nil if bounds is invalid or s has no IPs in it.
+func (s *IPSet) PrefixesIn(bounds netip.Prefix) []netip.Prefix {
+	br := RangeOfPrefix(bounds)
+	if !br.IsValid() {
+		return nil
+	}
+	var out []netip.Prefix
+	for _, r := range s.rr {
+		if c, ok := r.Clamp(br); ok {
+			out = c.AppendPrefixes(out)
+		}
+	}
+	return out
+}
+
+// PrefixesExcluding returns the minimum and sorted set of IP prefixes
+// that covers the IPs of s outside exclude. It does not modify s.
+//
+// If exclude is invalid, PrefixesExcluding returns the same prefixes
+// as Prefixes.
+func (s *IPSet) PrefixesExcluding(exclude netip.Prefix) []netip.Prefix {
+	ex := RangeOfPrefix(exclude)
 	out := make([]netip.Prefix, 0, len(s.rr))
 	for _, r := range s.rr {
-		out = append(out, r.Prefixes()...)
+		if !r.Overlaps(ex) {
+			out = r.AppendPrefixes(out)
+			continue
+		}
+		if r.from.Less(ex.from) {
+			out = IPRange{r.from, ex.from.Prev()}.AppendPrefixes(out)
+		}
+		if ex.to.Less(r.to) {
+			out = IPRange{ex.to.Next(), r.to}.AppendPrefixes(out)
+		}
 	}
 	return out
 }
 
+// UtilizationIn returns the fraction of IPs in bounds that are also in
+// s, in the range [0, 1]. It returns 0 if bounds is invalid.
+func (s *IPSet) UtilizationIn(bounds netip.Prefix) float64 {
+	br := RangeOfPrefix(bounds)
+	if !br.IsValid() {
+		return 0
+	}
+	used := new(big.Int)
+	for _, r := range s.rr {
+		if c, ok := r.Intersect(br); ok {
+			used.Add(used, c.size())
+		}
+	}
+	f, _ := new(big.Rat).SetFrac(used, br.size()).Float64()
+	return f
+}
+
+// ForEachPrefix calls f for each of the prefixes Prefixes would
+// return, in order, without building the full list. It stops early if
+// f returns false.
+func (s *IPSet) ForEachPrefix(f func(netip.Prefix) bool) {
+	for _, r := range s.rr {
+		if !forEachRangePrefix(r.prefixFrom128AndBits, u128From16(r.from.As16()), u128From16(r.to.As16()), f) {
+			return
+		}
+	}
+}
+
+// WriteCIDRs writes the prefixes returned by Prefixes to w, one per
+// line, and returns the number of prefixes written.
+//
+// Each line is written with a separate call to w.Write, without
+// building the full list of prefixes first. Callers writing to an
+// unbuffered destination may want to wrap it with bufio.Writer.
+func (s *IPSet) WriteCIDRs(w io.Writer) (n int, err error) {
+	n, _, err = s.writeCIDRs(w)
+	return n, err
+}
+
+// WriteTo implements io.WriterTo. It writes the same lines as
+// WriteCIDRs and returns the number of bytes written.
+func (s *IPSet) WriteTo(w io.Writer) (written int64, err error) {
+	_, written, err = s.writeCIDRs(w)
+	return written, err
+}
+
+// writeCIDRs implements WriteCIDRs and WriteTo, returning both the
+// number of prefixes and the number of bytes written.
+func (s *IPSet) writeCIDRs(w io.Writer) (n int, written int64, err error) {
+	var pfxs []netip.Prefix
+	var line []byte
+	for _, r := range s.rr {
+		pfxs = r.AppendPrefixes(pfxs[:0])
+		for _, p := range pfxs {
+			line = append(p.AppendTo(line[:0]), '\n')
+			m, err := w.Write(line)
+			written += int64(m)
+			if err != nil {
+				return n, written, err
+			}
+			n++
+		}
+	}
+	return n, written, nil
+}
+
+// AppendTo appends format(r) to dst for each of the ranges r returned
+// by Ranges, in order, and returns the extended buffer. Any separators
+// between ranges are up to format.
+func (s *IPSet) AppendTo(dst []byte, format func(IPRange) string) []byte {
+	for _, r := range s.rr {
+		dst = append(dst, format(r)...)
+	}
+	return dst
+}
+
+// PrefixesSortedByLen returns the same prefixes as Prefixes, ordered by
+// descending prefix length and then by ascending address.
+// This longest-prefix-first order suits tables that require more
+// specific routes to be inserted first.
+func (s *IPSet) PrefixesSortedByLen() []netip.Prefix {
+	pfxs := s.Prefixes()
+	sort.Slice(pfxs, func(i, j int) bool {
+		if pfxs[i].Bits() != pfxs[j].Bits() {
+			return pfxs[i].Bits() > pfxs[j].Bits()
+		}
+		return pfxs[i].Addr().Less(pfxs[j].Addr())
+	})
+	return pfxs
+}
+
+// PrefixLenHistogram returns the number of prefixes of each length
+// among those returned by Prefixes. Lengths with no prefixes are
+// omitted.
+func (s *IPSet) PrefixLenHistogram() map[uint8]int {
+	h := make(map[uint8]int)
+	var pfxs []netip.Prefix
+	for _, r := range s.rr {
+		pfxs = r.AppendPrefixes(pfxs[:0])
+		for _, p := range pfxs {
+			h[uint8(p.Bits())]++
+		}
+	}
+	return h
+}
+
+// CountPrefixes returns the number of prefixes Prefixes would return,
+// without allocating them.
+func (s *IPSet) CountPrefixes() int {
+	n := 0
+	for _, r := range s.rr {
+		n += countRangePrefixes(u128From16(r.from.As16()), u128From16(r.to.As16()))
+	}
+	return n
+}
+
+// ExpandIPs returns the IPs in s in ascending order, up to at most
+// limit of them. If s contains more than limit IPs, truncated is true.
+func (s *IPSet) ExpandIPs(limit int) (ips []netip.Addr, truncated bool) {
+	for _, r := range s.rr {
+		for ip := r.from; ip.IsValid() && !r.to.Less(ip); ip = ip.Next() {
+			if len(ips) >= limit {
+				return ips, true
+			}
+			ips = append(ips, ip)
+		}
+	}
+	return ips, false
+}
+
+// RandomIP returns an IP chosen uniformly at random from all IPs in s,
+// using rnd as the source of randomness. Each range of s is chosen with
+// probability proportional to its size.
+//
+// If s is empty, ok is false.
+func (s *IPSet) RandomIP(rnd *rand.Rand) (ip netip.Addr, ok bool) {
+	if len(s.rr) == 0 {
+		return netip.Addr{}, false
+	}
+	sizes := make([]*big.Int, len(s.rr))
+	total := new(big.Int)
+	for i, r := range s.rr {
+		sizes[i] = r.size()
+		total.Add(total, sizes[i])
+	}
+	n := new(big.Int).Rand(rnd, total)
+	for i, r := range s.rr {
+		if n.Cmp(sizes[i]) < 0 {
+			off, _ := u128FromBig(n)
+			return addrFrom128(u128From16(r.from.As16()).add(off), r.from), true
+		}
+		n.Sub(n, sizes[i])
+	}
+	panic("unreachable")
+}
+
+// String returns a string representation of s for debugging.
+//
+// The form is the sorted, minimal list of s's ranges, as formatted by
+// IPRange.String, separated by commas and enclosed in braces.
+// An empty set is "{}".
+func (s *IPSet) String() string {
+	b := make([]byte, 0, 2+len(s.rr)*len("255.255.255.255-255.255.255.255,"))
+	b = append(b, '{')
+	for i, r := range s.rr {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = r.AppendTo(b)
+	}
+	b = append(b, '}')
+	return string(b)
+}
+
+// FilterFamily returns a new IPSet containing only the IPv4 ranges of
+// s if v4 is true, or only the IPv6 ranges of s otherwise.
+// IPv4-mapped IPv6 addresses are IPv6.
+func (s *IPSet) FilterFamily(v4 bool) *IPSet {
+	return &IPSet{rr: s.RangesFamily(v4)}
+}
+
+// RangesFamily returns the minimum and sorted set of IP ranges that
+// covers the IPv4 addresses in s if v4 is true, or the IPv6 addresses
+// in s otherwise. IPv4-mapped IPv6 addresses are IPv6.
+func (s *IPSet) RangesFamily(v4 bool) []IPRange {
+	i := s.v6Start()
+	if v4 {
+		return append([]IPRange{}, s.rr[:i]...)
+	}
+	return append([]IPRange{}, s.rr[i:]...)
+}
+
+// OnlyV4 reports whether s is non-empty and contains only IPv4
+// addresses.
+func (s *IPSet) OnlyV4() bool {
+	return len(s.rr) > 0 && s.v6Start() == len(s.rr)
+}
+
+// OnlyV6 reports whether s is non-empty and contains only IPv6
+// addresses, including IPv4-mapped IPv6 addresses.
+func (s *IPSet) OnlyV6() bool {
+	return len(s.rr) > 0 && s.v6Start() == 0
+}
+
+// SingleFamily returns s if it contains addresses of at most one
+// address family, and an error if it contains both IPv4 and IPv6
+// addresses. IPv4-mapped IPv6 addresses are IPv6.
+//
+// An empty set has no addresses of either family, and is returned
+// without error.
+func (s *IPSet) SingleFamily() (*IPSet, error) {
+	if i := s.v6Start(); i > 0 && i < len(s.rr) {
+		return nil, errors.New("IPSet contains both IPv4 and IPv6 addresses")
+	}
+	return s, nil
+}
+
+// V4Ranges returns the ranges of s as [from, to] pairs of IPv4
+// addresses in big-endian uint32 form, in ascending order. It returns
+// nil and false if s contains any IPv6 addresses, including
+// IPv4-mapped ones.
+func (s *IPSet) V4Ranges() ([][2]uint32, bool) {
+	if s.v6Start() < len(s.rr) {
+		return nil, false
+	}
+	out := make([][2]uint32, len(s.rr))
+	for i, r := range s.rr {
+		from, to := r.from.As4(), r.to.As4()
+		out[i] = [2]uint32{binary.BigEndian.Uint32(from[:]), binary.BigEndian.Uint32(to[:])}
+	}
+	return out, true
+}
+
+// Canonicalize returns a copy of s in which all IPv4-mapped IPv6
+// addresses (::ffff:0.0.0.0/96) are replaced by their IPv4 form.
+//
+// The returned set contains an IPv4 address if s contains either form
+// of it. Canonicalize is idempotent.
+func (s *IPSet) Canonicalize() *IPSet {
+	mapped := RangeOfPrefix(netip.PrefixFrom(netip.AddrFrom16([16]byte{10: 0xff, 11: 0xff}), 96))
+	var b IPSetBuilder
+	b.AddSet(s)
+	b.RemoveRange(mapped)
+	for _, r := range s.rr[s.v6Start():] {
+		if c, ok := r.Clamp(mapped); ok {
+			b.AddRange(IPRangeFrom(c.from.Unmap(), c.to.Unmap()))
+		}
+	}
+	ret, _ := b.IPSet()
+	return ret
+}
+
+// Invert returns the complement of s within the address families
+// present in s. That is, if s contains any IPv4 addresses, the result
+// contains all IPv4 addresses not in s, and likewise for IPv6.
+//
+// An empty set implies no address family, so its inversion is also
+// empty. Use IPSetBuilder.Complement to complement over both families.
+func (s *IPSet) Invert() *IPSet {
+	var b IPSetBuilder
+	i := s.v6Start()
+	if i > 0 {
+		b.AddPrefix(netip.PrefixFrom(netip.IPv4Unspecified(), 0))
+	}
+	if i < len(s.rr) {
+		b.AddPrefix(netip.PrefixFrom(netip.IPv6Unspecified(), 0))
+	}
+	b.RemoveSet(s)
+	ret, _ := b.IPSet()
+	return ret
+}
+
+// v6Start returns the index of the first IPv6 range in s.rr, or
+// len(s.rr) if there is none. It relies on IPv4 ranges sorting before
+// IPv6 ranges.
+func (s *IPSet) v6Start() int {
+	return sort.Search(len(s.rr), func(i int) bool {
+		return !s.rr[i].from.Is4()
+	})
+}
+
 // Equal reports whether s and o represent the same set of IP
 // addresses.
 func (s *IPSet) Equal(o *IPSet) bool {
@@ -363,6 +1006,168 @@ func (s *IPSet) Equal(o *IPSet) bool {
 	return true
 }
 
+// EqualContent reports whether s and o represent the same set of IP
+// addresses once IPv4-mapped IPv6 addresses are treated as the IPv4
+// addresses they map, as by Canonicalize. Equal, by contrast, treats
+// them as distinct.
+func (s *IPSet) EqualContent(o *IPSet) bool {
+	return s.Canonicalize().Equal(o.Canonicalize())
+}
+
+// Hash returns a hash of the IPs in s. Sets that are Equal have the
+// same hash, and unequal sets have different hashes with high
+// probability. The hash is stable across processes and versions of
+// this package; it is not cryptographically secure.
+func (s *IPSet) Hash() uint64 {
+	h := fnv.New64a()
+	var buf [1 + 2*16]byte
+	for _, r := range s.rr {
+		buf[0] = byte(r.from.BitLen())
+		from, to := r.from.As16(), r.to.As16()
+		copy(buf[1:], from[:])
+		copy(buf[17:], to[:])
+		h.Write(buf[:])
+	}
+	return h.Sum64()
+}
+
+// Diff reports the changes from old to s: added are the minimum and
+// sorted ranges of IPs in s but not in old, and removed are those in
+// old but not in s.
+func (s *IPSet) Diff(old *IPSet) (added, removed []IPRange) {
+	var a, r IPSetBuilder
+	a.AddSet(s)
+	a.RemoveSet(old)
+	r.AddSet(old)
+	r.RemoveSet(s)
+	a.normalize()
+	r.normalize()
+	return a.in, r.in
+}
+
+// Plus returns the set of IPs in s or b. It does not modify s or b.
+func (s *IPSet) Plus(b *IPSet) *IPSet {
+	var sb IPSetBuilder
+	sb.AddSet(s)
+	sb.AddSet(b)
+	ret, _ := sb.IPSet()
+	return ret
+}
+
+// Minus returns the set of IPs in s but not in b. It does not modify
+// s or b.
+func (s *IPSet) Minus(b *IPSet) *IPSet {
+	var sb IPSetBuilder
+	sb.AddSet(s)
+	sb.RemoveSet(b)
+	ret, _ := sb.IPSet()
+	return ret
+}
+
+// And returns the set of IPs in both s and b. It does not modify s or
+// b.
+func (s *IPSet) And(b *IPSet) *IPSet {
+	var sb IPSetBuilder
+	sb.AddSet(s)
+	sb.Intersect(b)
+	ret, _ := sb.IPSet()
+	return ret
+}
+
+// SymmetricDifference returns the set of IPs that are in exactly one
+// of s and b. It is computed in a single pass over the sorted ranges of
+// both sets.
+func (s *IPSet) SymmetricDifference(b *IPSet) *IPSet {
+	var out []IPRange
+	emit := func(r IPRange) {
+		if n := len(out); n > 0 && out[n-1].to.Next() == r.from {
+			out[n-1].to = r.to
+			return
+		}
+		out = append(out, r)
+	}
+	ra, rb := s.rr, b.rr
+	var x, y IPRange // current heads of ra and rb, trimmed as we go
+	if len(ra) > 0 {
+		x = ra[0]
+	}
+	if len(rb) > 0 {
+		y = rb[0]
+	}
+	for len(ra) > 0 && len(rb) > 0 {
+		switch {
+		case x.entirelyBefore(y):
+			emit(x)
+			if ra = ra[1:]; len(ra) > 0 {
+				x = ra[0]
+			}
+			continue
+		case y.entirelyBefore(x):
+			emit(y)
+			if rb = rb[1:]; len(rb) > 0 {
+				y = rb[0]
+			}
+			continue
+		}
+		// x and y overlap. Keep whichever part starts before the
+		// overlap, drop the overlap itself, and carry forward whichever
+		// part extends past it.
+		if x.from.Less(y.from) {
+			emit(IPRange{x.from, y.from.Prev()})
+		} else if y.from.Less(x.from) {
+			emit(IPRange{y.from, x.from.Prev()})
+		}
+		switch {
+		case x.to == y.to:
+			if ra = ra[1:]; len(ra) > 0 {
+				x = ra[0]
+			}
+			if rb = rb[1:]; len(rb) > 0 {
+				y = rb[0]
+			}
+		case x.to.Less(y.to):
+			y.from = x.to.Next()
+			if ra = ra[1:]; len(ra) > 0 {
+				x = ra[0]
+			}
+		default:
+			x.from = y.to.Next()
+			if rb = rb[1:]; len(rb) > 0 {
+				y = rb[0]
+			}
+		}
+	}
+	if len(ra) > 0 {
+		emit(x)
+		for _, r := range ra[1:] {
+			emit(r)
+		}
+	}
+	if len(rb) > 0 {
+		emit(y)
+		for _, r := range rb[1:] {
+			emit(r)
+		}
+	}
+	return &IPSet{rr: out}
+}
+
+// TrimTo returns the set of IPs in s that are also in bounds. Ranges of
+// s straddling either end of bounds are split there.
+//
+// If bounds is invalid, TrimTo returns an empty set.
+func (s *IPSet) TrimTo(bounds IPRange) *IPSet {
+	var rr []IPRange
+	// Clipping s's sorted, disjoint, non-adjacent ranges to a single
+	// range leaves them so, so the result needs no normalization.
+	for _, r := range s.rr {
+		if c, ok := r.Intersect(bounds); ok {
+			rr = append(rr, c)
+		}
+	}
+	return &IPSet{rr: rr}
+}
+
 // Contains reports whether ip is in s.
 // If ip has an IPv6 zone, Contains returns false,
 // because IPSets do not track zones.
@@ -382,6 +1187,28 @@ func (s *IPSet) Contains(ip netip.Addr) bool {
 	return s.rr[i].contains(ip)
 }
 
+// ContainsAll reports whether every IP in ips is in s. It stops at the
+// first IP that is not. If ips is empty, it reports true.
+func (s *IPSet) ContainsAll(ips []netip.Addr) bool {
+	for _, ip := range ips {
+		if !s.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// ContainsAny reports whether at least one IP in ips is in s. It stops
+// at the first IP that is. If ips is empty, it reports false.
+func (s *IPSet) ContainsAny(ips []netip.Addr) bool {
+	for _, ip := range ips {
+		if s.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // ContainsRange reports whether all IPs in r are in s.
 func (s *IPSet) ContainsRange(r IPRange) bool {
 	for _, x := range s.rr {
@@ -412,13 +1239,15 @@ func (s *IPSet) Overlaps(b *IPSet) bool {
 
 // OverlapsRange reports whether any IP in r is also in s.
 func (s *IPSet) OverlapsRange(r IPRange) bool {
-	// TODO: sorted ranges lets us do this more efficiently.
-	for _, x := range s.rr {
-		if x.Overlaps(r) {
-			return true
-		}
+	if !r.IsValid() {
+		return false
 	}
-	return false
+	// s.rr is sorted and non-overlapping, so only the first range
+	// ending at or after r.From can overlap r.
+	i := sort.Search(len(s.rr), func(i int) bool {
+		return !s.rr[i].to.Less(r.from)
+	})
+	return i < len(s.rr) && s.rr[i].Overlaps(r)
 }
 
 // OverlapsPrefix reports whether any IP in p is also in s.
@@ -461,6 +1290,210 @@ func (s *IPSet) RemoveFreePrefix(bitLen uint8) (p netip.Prefix, newSet *IPSet, o
 	return prefix, newSet, true
 }
 
+// RangesJSON returns the ranges of s as a JSON array of objects with
+// "from" and "to" fields, such as
+// [{"from":"10.0.0.0","to":"10.0.0.255"}].
+func (s *IPSet) RangesJSON() ([]byte, error) {
+	type jsonRange struct {
+		From netip.Addr `json:"from"`
+		To   netip.Addr `json:"to"`
+	}
+	rr := make([]jsonRange, len(s.rr))
+	for i, r := range s.rr {
+		rr[i] = jsonRange{r.from, r.to}
+	}
+	return json.Marshal(rr)
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+//
+// The encoding is stable: a uvarint count of ranges, followed by each
+// of s's ranges in ascending order. Each range is a single byte holding
+// its address length in bytes (4 or 16), followed by its From and To
+// addresses in network byte order.
+//
+// encoding/gob uses this encoding, so IPSets can be sent over net/rpc
+// without a separate GobEncode method.
+func (s *IPSet) MarshalBinary() ([]byte, error) {
+	b := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(s.rr)*(1+2*16))
+	b = b[:binary.PutUvarint(b, uint64(len(s.rr)))]
+	for _, r := range s.rr {
+		b = append(b, byte(r.from.BitLen()/8))
+		b = append(b, r.from.AsSlice()...)
+		b = append(b, r.to.AsSlice()...)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+// It expects data in the form generated by MarshalBinary.
+// It returns an error if *s is not empty.
+func (s *IPSet) UnmarshalBinary(b []byte) error {
+	if len(s.rr) != 0 {
+		return errors.New("refusing to Unmarshal into non-empty IPSet")
+	}
+	n, k := binary.Uvarint(b)
+	if k <= 0 {
+		return errors.New("invalid IPSet encoding: bad range count")
+	}
+	b = b[k:]
+	var sb IPSetBuilder
+	for i := uint64(0); i < n; i++ {
+		if len(b) == 0 {
+			return fmt.Errorf("invalid IPSet encoding: want %d ranges, got %d", n, i)
+		}
+		l := int(b[0])
+		if l != 4 && l != 16 {
+			return fmt.Errorf("invalid IPSet encoding: bad address length %d", l)
+		}
+		if len(b) < 1+2*l {
+			return errors.New("invalid IPSet encoding: truncated range")
+		}
+		from, _ := netip.AddrFromSlice(b[1 : 1+l])
+		to, _ := netip.AddrFromSlice(b[1+l : 1+2*l])
+		r := IPRangeFrom(from, to)
+		if !r.IsValid() {
+			return fmt.Errorf("invalid IPSet encoding: range %v to %v not valid", from, to)
+		}
+		sb.AddRange(r)
+		b = b[1+2*l:]
+	}
+	if len(b) != 0 {
+		return errors.New("invalid IPSet encoding: trailing data")
+	}
+	ss, err := sb.IPSet()
+	if err != nil {
+		return err
+	}
+	s.rr = ss.rr
+	return nil
+}
+
+// RemoveFreePrefixFrom is like RemoveFreePrefix, but instead of the
+// best-fitting prefix, it removes the lowest-addressed prefix of length
+// bitLen contained in s, or the highest-addressed one if highest is
+// true.
+//
+// If no contiguous prefix of length bitLen exists in s,
+// RemoveFreePrefixFrom returns ok=false.
+func (s *IPSet) RemoveFreePrefixFrom(bitLen uint8, highest bool) (p netip.Prefix, newSet *IPSet, ok bool) {
+	var pfxs []netip.Prefix
+	for i := range s.rr {
+		r := s.rr[i]
+		if highest {
+			r = s.rr[len(s.rr)-1-i]
+		}
+		if int(bitLen) > r.from.BitLen() {
+			continue
+		}
+		pfxs = r.AppendPrefixes(pfxs[:0])
+		for j := range pfxs {
+			prefix := pfxs[j]
+			if highest {
+				prefix = pfxs[len(pfxs)-1-j]
+			}
+			if uint8(prefix.Bits()) > bitLen {
+				continue
+			}
+			if highest {
+				p = netip.PrefixFrom(PrefixLastIP(prefix), int(bitLen)).Masked()
+			} else {
+				p = netip.PrefixFrom(prefix.Addr(), int(bitLen))
+			}
+			var b IPSetBuilder
+			b.AddSet(s)
+			b.RemovePrefix(p)
+			newSet, _ = b.IPSet()
+			return p, newSet, true
+		}
+	}
+	return netip.Prefix{}, s, false
+}
+
+// FreePrefixes returns all prefixes of length bitLen that are entirely
+// contained in s, in ascending order. Unlike RemoveFreePrefix, it does
+// not remove them.
+//
+// The result grows exponentially with the difference between bitLen and
+// the lengths of s's prefixes; callers should avoid asking, for
+// example, for all /64s in a large IPv6 set.
+func (s *IPSet) FreePrefixes(bitLen uint8) []netip.Prefix {
+	var out []netip.Prefix
+	for _, r := range s.rr {
+		if int(bitLen) > r.from.BitLen() {
+			continue
+		}
+		for _, prefix := range r.Prefixes() {
+			if uint8(prefix.Bits()) > bitLen {
+				continue
+			}
+			for p := netip.PrefixFrom(prefix.Addr(), int(bitLen)); p.IsValid() && prefix.Contains(p.Addr()); {
+				out = append(out, p)
+				p = netip.PrefixFrom(AddrNext(PrefixLastIP(p)), int(bitLen))
+			}
+		}
+	}
+	return out
+}
+
+// LargestFreePrefix returns the prefix covering the most addresses that
+// is entirely contained in s. If several are equally large, it returns
+// the lowest. It reports false if s is empty.
+//
+// Prefix size is compared by address count, so an IPv6 /64 is larger
+// than any IPv4 prefix.
+func (s *IPSet) LargestFreePrefix() (largest netip.Prefix, ok bool) {
+	s.ForEachPrefix(func(p netip.Prefix) bool {
+		if !ok || p.Addr().BitLen()-p.Bits() > largest.Addr().BitLen()-largest.Bits() {
+			largest, ok = p, true
+		}
+		return true
+	})
+	return largest, ok
+}
+
+// DenseRegions returns, in ascending order, the prefixes of length bits
+// in which at least the fraction minDensity of addresses are in s. Only
+// prefixes containing at least one IP of s are considered. This gives a
+// lossy view of where s's IPs are concentrated.
+//
+// Like FreePrefixes, the cost grows with the number of length-bits
+// prefixes that s's ranges span.
+func (s *IPSet) DenseRegions(minDensity float64, bits uint8) []netip.Prefix {
+	var out []netip.Prefix
+	var cur netip.Prefix
+	var n float64 // IPs of s in cur
+	flush := func() {
+		if cur.IsValid() && n/math.Ldexp(1, cur.Addr().BitLen()-cur.Bits()) >= minDensity {
+			out = append(out, cur)
+		}
+	}
+	for _, r := range s.rr {
+		if int(bits) > r.from.BitLen() {
+			continue
+		}
+		for from := r.from; ; {
+			p, _ := from.Prefix(int(bits))
+			if p != cur {
+				flush()
+				cur, n = p, 0
+			}
+			to := PrefixLastIP(p)
+			if r.to.Less(to) {
+				to = r.to
+			}
+			d := u128From16(to.As16()).sub(u128From16(from.As16()))
+			n += math.Ldexp(float64(d.hi), 64) + float64(d.lo) + 1
+			if to == r.to {
+				break
+			}
+			from = to.Next()
+		}
+	}
+	flush()
+	return out
+}
+
 type multiErr []error
 
 func (e multiErr) Error() string {
@@ -6,12 +6,20 @@ package netipx
 
 import (
 	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net/netip"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func buildIPSet(b *IPSetBuilder) *IPSet {
@@ -541,6 +549,42 @@ func TestIPSetContains(t *testing.T) {
 	}
 }
 
+func TestIPSetContainsAll(t *testing.T) {
+	s := mustIPSet("+10.0.0.0-10.0.0.255", "+fed0::-fed0::ff")
+	tests := []struct {
+		ips  []IP
+		want bool
+	}{
+		{mustIPs("10.0.0.1", "10.0.0.255", "fed0::5"), true},
+		{mustIPs("10.0.0.1", "10.0.1.0", "fed0::5"), false},
+		{mustIPs("10.0.0.1", "fed0::5%eth0"), false},
+		{nil, true},
+	}
+	for _, tt := range tests {
+		if got := s.ContainsAll(tt.ips); got != tt.want {
+			t.Errorf("ContainsAll(%v) = %v; want %v", tt.ips, got, tt.want)
+		}
+	}
+}
+
+func TestIPSetContainsAny(t *testing.T) {
+	s := mustIPSet("+10.0.0.0-10.0.0.255", "+fed0::-fed0::ff")
+	tests := []struct {
+		ips  []IP
+		want bool
+	}{
+		{mustIPs("10.0.0.1", "10.0.1.0", "192.168.0.1"), true},
+		{mustIPs("10.0.1.0", "fed0::100", "fed0::5"), true},
+		{mustIPs("10.0.1.0", "fed0::100", "fed0::5%eth0"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := s.ContainsAny(tt.ips); got != tt.want {
+			t.Errorf("ContainsAny(%v) = %v; want %v", tt.ips, got, tt.want)
+		}
+	}
+}
+
 func TestIPSetFuzz(t *testing.T) {
 	t.Parallel()
 	if testing.Short() {
@@ -747,3 +791,2044 @@ func TestIPSetEqual(t *testing.T) {
 	b.Remove(MustParseIP("1.1.1.3"))
 	assertEqual(true)
 }
+
+func TestIPSetAppendRanges(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.255.255.255",
+		"-10.1.2.3-10.1.2.3",
+		"+fed0::400-fed0::4ff",
+	)
+	want := s.Ranges()
+	if got := s.AppendRanges(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("AppendRanges(nil) = %v; want %v", got, want)
+	}
+
+	prefix := []IPRange{MustParseIPRange("1.2.3.4-1.2.3.5")}
+	got := s.AppendRanges(prefix)
+	if !reflect.DeepEqual(got[:1], prefix) || !reflect.DeepEqual(got[1:], want) {
+		t.Errorf("AppendRanges(%v) = %v; want %v followed by %v", prefix, got, prefix, want)
+	}
+
+	if got := new(IPSet).AppendRanges(nil); len(got) != 0 {
+		t.Errorf("empty IPSet AppendRanges = %v; want empty", got)
+	}
+}
+
+func BenchmarkIPSetRanges(b *testing.B) {
+	s := mustIPSet(
+		"+10.0.0.0-10.255.255.255",
+		"-10.1.2.3-10.1.2.3",
+		"-10.3.0.0-10.3.255.255",
+		"+fed0::400-fed0::4ff",
+	)
+	b.Run("Ranges", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sinkIPRangeSlice = s.Ranges()
+		}
+	})
+	b.Run("AppendRanges", func(b *testing.B) {
+		b.ReportAllocs()
+		buf := make([]IPRange, 0, 8)
+		for i := 0; i < b.N; i++ {
+			sinkIPRangeSlice = s.AppendRanges(buf[:0])
+		}
+	})
+}
+
+func TestIPSetBuilderCompact(t *testing.T) {
+	var b IPSetBuilder
+	for i := 0; i < 1000; i++ {
+		b.AddPrefix(netip.PrefixFrom(IPv4(10, uint8(i>>8), uint8(i), 0), 24))
+		b.Add(IPv4(11, uint8(i>>8), uint8(i), 0))
+	}
+	b.RemovePrefix(mustIPPrefix("11.0.0.0/8"))
+	b.RemovePrefix(mustIPPrefix("10.1.0.0/16"))
+	want := buildIPSet(&b)
+	before := cap(b.in)
+
+	b.Compact()
+	if got := buildIPSet(&b); !got.Equal(want) {
+		t.Errorf("after Compact, set = %v; want %v", got, want)
+	}
+	if len(b.in) != cap(b.in) || cap(b.in) >= before {
+		t.Errorf("after Compact, len/cap(in) = %d/%d, cap before %d; want len == cap < cap before", len(b.in), cap(b.in), before)
+	}
+	if len(b.out) != 0 {
+		t.Errorf("after Compact, len(out) = %d; want 0", len(b.out))
+	}
+
+	// The builder remains usable.
+	b.Add(mustIP("1.2.3.4"))
+	if s := buildIPSet(&b); !s.Contains(mustIP("1.2.3.4")) || !s.Contains(mustIP("10.0.0.1")) {
+		t.Errorf("after Compact and Add, set = %v", s)
+	}
+}
+
+func TestIPSetBuilderClear(t *testing.T) {
+	var b IPSetBuilder
+	for i := 0; i < 100; i++ {
+		b.AddPrefix(netip.PrefixFrom(IPv4(10, 0, uint8(2*i), 0), 24))
+	}
+	b.Remove(mustIP("10.0.0.1"))
+	b.AddPrefix(IPPrefix{}) // accumulates an error
+	b.normalize()
+	before := cap(b.in)
+
+	b.Clear()
+	if cap(b.in) != before {
+		t.Errorf("after Clear, cap(in) = %d; want %d", cap(b.in), before)
+	}
+	if s, err := b.IPSet(); err != nil || len(s.Ranges()) != 0 {
+		t.Errorf("after Clear, IPSet() = %v, %v; want empty, nil", s, err)
+	}
+
+	b.AddPrefix(mustIPPrefix("192.168.0.0/24"))
+	b.Remove(mustIP("192.168.0.1"))
+	want := mustIPSet("+192.168.0.0-192.168.0.255", "-192.168.0.1-192.168.0.1")
+	if got := buildIPSet(&b); !got.Equal(want) {
+		t.Errorf("after Clear and refill, set = %v; want %v", got, want)
+	}
+}
+
+func TestIPSetBuilderPrefixString(t *testing.T) {
+	var b IPSetBuilder
+	for _, cidr := range []string{"10.0.0.0/8", "fed0::/120"} {
+		if err := b.AddPrefixString(cidr); err != nil {
+			t.Errorf("AddPrefixString(%q) = %v", cidr, err)
+		}
+	}
+	if err := b.RemovePrefixString("10.1.0.0/16"); err != nil {
+		t.Errorf("RemovePrefixString(%q) = %v", "10.1.0.0/16", err)
+	}
+	for _, bad := range []string{"", "10.0.0.0", "10.0.0.0/33", "foo/8", "10.0.0.0-10.0.0.255"} {
+		if err := b.AddPrefixString(bad); err == nil {
+			t.Errorf("AddPrefixString(%q) succeeded; want error", bad)
+		}
+		if err := b.RemovePrefixString(bad); err == nil {
+			t.Errorf("RemovePrefixString(%q) succeeded; want error", bad)
+		}
+	}
+	want := mustIPSet("+10.0.0.0-10.255.255.255", "-10.1.0.0-10.1.255.255", "+fed0::-fed0::ff")
+	if got := buildIPSet(&b); !got.Equal(want) {
+		t.Errorf("set = %v; want %v", got, want)
+	}
+}
+
+func TestIPSetBuilderAddRemoveIPs(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	randIPs := func(n int) []IP {
+		ips := make([]IP, n)
+		for i := range ips {
+			ips[i] = IPv4(10, 0, uint8(rnd.Intn(4)), uint8(rnd.Intn(256)))
+		}
+		return ips
+	}
+	for i := 0; i < 100; i++ {
+		add, remove, addAgain := randIPs(300), randIPs(100), randIPs(50)
+
+		var one IPSetBuilder
+		one.AddPrefix(mustIPPrefix("10.0.2.0/24"))
+		for _, ip := range add {
+			one.Add(ip)
+		}
+		for _, ip := range remove {
+			one.Remove(ip)
+		}
+		for _, ip := range addAgain {
+			one.Add(ip)
+		}
+
+		var batch IPSetBuilder
+		batch.AddPrefix(mustIPPrefix("10.0.2.0/24"))
+		batch.AddIPs(add)
+		batch.RemoveIPs(remove)
+		batch.AddIPs(addAgain)
+
+		if got, want := buildIPSet(&batch), buildIPSet(&one); !got.Equal(want) {
+			t.Fatalf("batch = %v; want %v", got, want)
+		}
+	}
+
+	var b IPSetBuilder
+	b.AddIPs(mustIPs("1.2.3.4"))
+	b.AddIPs([]IP{{}})
+	b.RemoveIPs([]IP{{}})
+	if _, err := b.IPSet(); err == nil {
+		t.Error("AddIPs/RemoveIPs with zero IP did not report an error")
+	}
+}
+
+func TestIPSetPrefixesIn(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.255.255.255",
+		"-10.1.2.3-10.1.2.3",
+		"-10.1.128.0-10.3.0.0",
+		"+fed0::400-fed0::4ff",
+	)
+	tests := []struct {
+		bounds IPPrefix
+		want   []IPPrefix
+	}{
+		{
+			mustIPPrefix("10.1.0.0/16"),
+			pxv("10.1.0.0/23", "10.1.2.0/31", "10.1.2.2/32", "10.1.2.4/30", "10.1.2.8/29",
+				"10.1.2.16/28", "10.1.2.32/27", "10.1.2.64/26", "10.1.2.128/25", "10.1.3.0/24",
+				"10.1.4.0/22", "10.1.8.0/21", "10.1.16.0/20", "10.1.32.0/19", "10.1.64.0/18"),
+		},
+		{mustIPPrefix("10.3.0.0/16"), pxv("10.3.0.1/32", "10.3.0.2/31", "10.3.0.4/30", "10.3.0.8/29",
+			"10.3.0.16/28", "10.3.0.32/27", "10.3.0.64/26", "10.3.0.128/25", "10.3.1.0/24",
+			"10.3.2.0/23", "10.3.4.0/22", "10.3.8.0/21", "10.3.16.0/20", "10.3.32.0/19",
+			"10.3.64.0/18", "10.3.128.0/17")},
+		{mustIPPrefix("10.200.0.0/16"), pxv("10.200.0.0/16")},
+		{mustIPPrefix("10.2.0.0/16"), nil},
+		{mustIPPrefix("0.0.0.0/0"), s.FilterFamily(true).Prefixes()},
+		{mustIPPrefix("fed0::/120"), nil},
+		{mustIPPrefix("fed0::400/120"), pxv("fed0::400/120")},
+		{mustIPPrefix("fed0::/16"), pxv("fed0::400/120")},
+		{IPPrefix{}, nil},
+	}
+	for _, tt := range tests {
+		if got := s.PrefixesIn(tt.bounds); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("PrefixesIn(%v) = %v; want %v", tt.bounds, got, tt.want)
+		}
+	}
+}
+
+func TestIPSetPrefixesExcluding(t *testing.T) {
+	s := mustIPSet("+10.0.0.0-10.0.0.255", "+10.0.2.0-10.0.2.255", "+fed0::-fed0::ff")
+	tests := []struct {
+		exclude IPPrefix
+		want    []IPPrefix
+	}{
+		{
+			mustIPPrefix("10.0.0.7/32"),
+			pxv("10.0.0.0/30", "10.0.0.4/31", "10.0.0.6/32", "10.0.0.8/29", "10.0.0.16/28",
+				"10.0.0.32/27", "10.0.0.64/26", "10.0.0.128/25", "10.0.2.0/24", "fed0::/120"),
+		},
+		{mustIPPrefix("10.0.0.0/32"), pxv("10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/30", "10.0.0.8/29",
+			"10.0.0.16/28", "10.0.0.32/27", "10.0.0.64/26", "10.0.0.128/25", "10.0.2.0/24", "fed0::/120")},
+		{mustIPPrefix("10.0.0.128/25"), pxv("10.0.0.0/25", "10.0.2.0/24", "fed0::/120")},
+		{mustIPPrefix("10.0.0.0/22"), pxv("fed0::/120")},
+		{mustIPPrefix("10.0.1.0/24"), s.Prefixes()},
+		{mustIPPrefix("fed0::80/121"), pxv("10.0.0.0/24", "10.0.2.0/24", "fed0::/121")},
+		{IPPrefix{}, s.Prefixes()},
+	}
+	for _, tt := range tests {
+		got := s.PrefixesExcluding(tt.exclude)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("PrefixesExcluding(%v) = %v; want %v", tt.exclude, got, tt.want)
+		}
+		var b IPSetBuilder
+		b.AddSet(s)
+		b.RemovePrefix(tt.exclude)
+		diff, _ := b.IPSet() // ignore the error for the invalid prefix
+		if want := diff.Prefixes(); !reflect.DeepEqual(got, want) {
+			t.Errorf("PrefixesExcluding(%v) = %v; want Difference then Prefixes = %v", tt.exclude, got, want)
+		}
+	}
+}
+
+func TestIPSetUtilizationIn(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.0.0.255",
+		"+10.0.1.0-10.0.1.63",
+		"+10.0.1.192-10.0.1.255",
+		"+fed0::-fed0::7f",
+	)
+	tests := []struct {
+		bounds string
+		want   float64
+	}{
+		{"10.0.0.0/24", 1},
+		{"10.0.1.0/24", 0.5},
+		{"10.0.0.0/23", 0.75},
+		{"10.0.2.0/24", 0},
+		{"10.0.0.128/25", 1},
+		{"0.0.0.0/0", 384.0 / (1 << 32)},
+		{"fed0::/120", 0.5},
+		{"fed0::/121", 1},
+	}
+	for _, tt := range tests {
+		if got := s.UtilizationIn(mustIPPrefix(tt.bounds)); got != tt.want {
+			t.Errorf("UtilizationIn(%s) = %v; want %v", tt.bounds, got, tt.want)
+		}
+	}
+	if got := mustIPSet().UtilizationIn(mustIPPrefix("10.0.0.0/8")); got != 0 {
+		t.Errorf("empty set UtilizationIn = %v; want 0", got)
+	}
+	if got := s.UtilizationIn(IPPrefix{}); got != 0 {
+		t.Errorf("UtilizationIn(IPPrefix{}) = %v; want 0", got)
+	}
+	// 2^128-1 of 2^128 addresses rounds to 1.
+	almostAll := mustIPSet("+::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe")
+	if got := almostAll.UtilizationIn(mustIPPrefix("::/0")); got != 1 {
+		t.Errorf("UtilizationIn(::/0) = %v; want 1", got)
+	}
+}
+
+func BenchmarkIPSetForEachRange(b *testing.B) {
+	s := mustIPSet(
+		"+10.0.0.0-10.255.255.255",
+		"-10.1.2.3-10.1.2.3",
+		"-10.3.0.0-10.3.255.255",
+		"+fed0::400-fed0::4ff",
+	)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.ForEachRange(func(r IPRange) bool {
+			sinkIPRange = r
+			return true
+		})
+	}
+}
+
+func TestIPSetForEachPrefix(t *testing.T) {
+	s := mustIPSet("+10.0.0.0-10.255.255.255", "-10.1.2.3-10.1.2.3", "+fed0::400-fed0::4ff")
+	var got []IPPrefix
+	s.ForEachPrefix(func(p IPPrefix) bool {
+		got = append(got, p)
+		return true
+	})
+	want := s.Prefixes()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ForEachPrefix visited %v; want %v", got, want)
+	}
+
+	// Stop in the middle of the first range's decomposition.
+	got = got[:0]
+	s.ForEachPrefix(func(p IPPrefix) bool {
+		got = append(got, p)
+		return len(got) < 5
+	})
+	if !reflect.DeepEqual(got, want[:5]) {
+		t.Errorf("ForEachPrefix stopping after 5 visited %v; want %v", got, want[:5])
+	}
+
+	mustIPSet().ForEachPrefix(func(p IPPrefix) bool {
+		t.Errorf("ForEachPrefix on empty set visited %v", p)
+		return true
+	})
+}
+
+// TestIPSetPrefixesNoRedundancy checks that Prefixes never returns a
+// prefix contained in another, and that the prefixes cover exactly s.
+func TestIPSetPrefixesNoRedundancy(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	randIP := func(v6 bool) IP {
+		if v6 {
+			return IPv6Raw([16]byte{0: 0xfe, 1: 0xd0, 14: uint8(rnd.Intn(4)), 15: uint8(rnd.Intn(256))})
+		}
+		return IPv4(10, uint8(rnd.Intn(4)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)))
+	}
+	for i := 0; i < 1000; i++ {
+		var b IPSetBuilder
+		for n := 1 + rnd.Intn(10); n > 0; n-- {
+			v6 := rnd.Intn(2) == 0
+			r := IPRangeFrom(randIP(v6), randIP(v6))
+			if !r.IsValid() {
+				r = IPRangeFrom(r.To(), r.From())
+			}
+			if rnd.Intn(3) == 0 {
+				b.RemoveRange(r)
+			} else {
+				b.AddRange(r)
+			}
+		}
+		s := buildIPSet(&b)
+		pfxs := s.Prefixes()
+		if o := OverlappingPrefixes(pfxs); len(o) > 0 {
+			t.Fatalf("(%v).Prefixes() = %v has overlapping prefixes %v", s, pfxs, o)
+		}
+		var back IPSetBuilder
+		for _, p := range pfxs {
+			back.AddPrefix(p)
+		}
+		if got := buildIPSet(&back); !got.Equal(s) {
+			t.Fatalf("(%v).Prefixes() = %v covers %v", s, pfxs, got)
+		}
+	}
+}
+
+func TestIPSetAppendPrefixes(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.255.255.255",
+		"-10.1.2.3-10.1.2.3",
+		"+fed0::400-fed0::4ff",
+	)
+	want := s.Prefixes()
+	if got := s.AppendPrefixes(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("AppendPrefixes(nil) = %v; want %v", got, want)
+	}
+
+	prefix := pxv("1.2.3.4/32")
+	got := s.AppendPrefixes(prefix)
+	if !reflect.DeepEqual(got[:1], prefix) || !reflect.DeepEqual(got[1:], want) {
+		t.Errorf("AppendPrefixes(%v) = %v; want %v followed by %v", prefix, got, prefix, want)
+	}
+
+	if got := new(IPSet).AppendPrefixes(nil); len(got) != 0 {
+		t.Errorf("empty IPSet AppendPrefixes = %v; want empty", got)
+	}
+}
+
+func BenchmarkIPSetPrefixes(b *testing.B) {
+	s := mustIPSet(
+		"+10.0.0.0-10.255.255.255",
+		"-10.1.2.3-10.1.2.3",
+		"+fed0::400-fed0::4ff",
+	)
+	b.Run("Prefixes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sinkIPPrefixSlice = s.Prefixes()
+		}
+	})
+	b.Run("AppendPrefixes", func(b *testing.B) {
+		b.ReportAllocs()
+		buf := make([]IPPrefix, 0, 32)
+		for i := 0; i < b.N; i++ {
+			sinkIPPrefixSlice = s.AppendPrefixes(buf[:0])
+		}
+	})
+}
+
+func TestIPSetMarshalBinary(t *testing.T) {
+	tests := []*IPSet{
+		mustIPSet(),
+		mustIPSet("+10.0.0.0-10.255.255.255", "-10.1.2.3-10.1.2.3"),
+		mustIPSet("+1.2.3.4-1.2.3.4", "+fed0::400-fed0::4ff", "+::ffff:1.2.3.4-::ffff:1.2.3.5"),
+	}
+	for _, s := range tests {
+		b, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatalf("(%v).MarshalBinary: %v", s, err)
+		}
+		var got IPSet
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatalf("UnmarshalBinary(%x): %v", b, err)
+		}
+		if !got.Equal(s) {
+			t.Errorf("UnmarshalBinary(%x) = %v; want %v", b, got.Ranges(), s.Ranges())
+		}
+		if err := got.UnmarshalBinary(b); len(s.rr) > 0 && err == nil {
+			t.Errorf("UnmarshalBinary into non-empty IPSet succeeded")
+		}
+	}
+
+	// The encoding is documented as stable; guard against accidental changes.
+	b, _ := mustIPSet("+10.0.0.0-10.0.0.255", "+::1-::2").MarshalBinary()
+	want := []byte{
+		2,
+		4, 10, 0, 0, 0, 10, 0, 0, 255,
+		16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("MarshalBinary = %v; want %v", b, want)
+	}
+
+	for _, bad := range [][]byte{
+		nil,
+		{1},
+		{1, 5, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+		{1, 4, 10, 0, 0, 0, 10, 0, 0},
+		{1, 4, 10, 0, 0, 255, 10, 0, 0, 0},
+		{0, 0},
+	} {
+		var s IPSet
+		if err := s.UnmarshalBinary(bad); err == nil {
+			t.Errorf("UnmarshalBinary(%v) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestIPSetRangesJSON(t *testing.T) {
+	s := mustIPSet("+10.0.0.0-10.0.0.255", "+10.0.1.5-10.0.1.5", "+fed0::-fed0::ff")
+	b, err := s.RangesJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `[{"from":"10.0.0.0","to":"10.0.0.255"},{"from":"10.0.1.5","to":"10.0.1.5"},{"from":"fed0::","to":"fed0::ff"}]`
+	if string(b) != want {
+		t.Errorf("RangesJSON = %s; want %s", b, want)
+	}
+
+	var got []map[string]string
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range s.Ranges() {
+		if got[i]["from"] != r.From().String() || got[i]["to"] != r.To().String() {
+			t.Errorf("RangesJSON element %d = %v; want from %v to %v", i, got[i], r.From(), r.To())
+		}
+	}
+
+	if b, err := mustIPSet().RangesJSON(); err != nil || string(b) != "[]" {
+		t.Errorf("empty RangesJSON = %s, %v; want [], nil", b, err)
+	}
+}
+
+func TestIPSetGob(t *testing.T) {
+	// IPSet has no exported fields; gob relies on its
+	// encoding.BinaryMarshaler and BinaryUnmarshaler implementation.
+	type msg struct {
+		Name string
+		Set  *IPSet
+	}
+	for _, s := range []*IPSet{
+		mustIPSet(),
+		mustIPSet("+10.0.0.0-10.255.255.255", "-10.1.2.3-10.1.2.3"),
+		mustIPSet("+1.2.3.4-1.2.3.4", "+fed0::400-fed0::4ff", "+::ffff:1.2.3.4-::ffff:1.2.3.5"),
+	} {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(msg{"x", s}); err != nil {
+			t.Fatalf("Encode(%v): %v", s, err)
+		}
+		var got msg
+		if err := gob.NewDecoder(&buf).Decode(&got); err != nil {
+			t.Fatalf("Decode(%v): %v", s, err)
+		}
+		if got.Name != "x" || got.Set == nil || !got.Set.Equal(s) {
+			t.Errorf("gob round trip of %v = %+v", s, got)
+		}
+	}
+}
+
+func FuzzIPSetMarshalBinary(f *testing.F) {
+	f.Add([]byte{0, 10, 20, 1, 15, 30})
+	f.Add([]byte{2, 0, 255, 3, 7, 9, 0, 100, 200})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Each three bytes of data are an operation: add or remove,
+		// IPv4 or IPv6, followed by the range's bounds.
+		raw := data
+		var sb IPSetBuilder
+		for ; len(data) >= 3; data = data[3:] {
+			lo, hi := data[1], data[2]
+			if hi < lo {
+				lo, hi = hi, lo
+			}
+			r := IPRangeFrom(IPv4(10, 0, 0, lo), IPv4(10, 0, 0, hi))
+			if data[0]&2 != 0 {
+				r = IPRangeFrom(IPv6Raw([16]byte{15: lo}), IPv6Raw([16]byte{15: hi}))
+			}
+			if data[0]&1 == 0 {
+				sb.AddRange(r)
+			} else {
+				sb.RemoveRange(r)
+			}
+		}
+		s := buildIPSet(&sb)
+		b, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got IPSet
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatalf("UnmarshalBinary(%x): %v", b, err)
+		}
+		if !got.Equal(s) {
+			t.Fatalf("round trip of %v = %v", s.Ranges(), got.Ranges())
+		}
+
+		// Arbitrary input must not panic.
+		var junk IPSet
+		junk.UnmarshalBinary(raw)
+	})
+}
+
+func TestIPSetString(t *testing.T) {
+	tests := []struct {
+		s    *IPSet
+		want string
+	}{
+		{mustIPSet(), "{}"},
+		{new(IPSet), "{}"},
+		{mustIPSet("+1.2.3.4-1.2.3.4"), "{1.2.3.4-1.2.3.4}"},
+		{
+			mustIPSet("+10.0.0.0-10.255.255.255", "-10.1.2.3-10.1.2.3"),
+			"{10.0.0.0-10.1.2.2,10.1.2.4-10.255.255.255}",
+		},
+		{
+			mustIPSet("+fed0::400-fed0::4ff", "+10.0.0.0-10.0.0.255"),
+			"{10.0.0.0-10.0.0.255,fed0::400-fed0::4ff}",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.s.String(); got != tt.want {
+			t.Errorf("String() = %q; want %q", got, tt.want)
+		}
+	}
+}
+
+func TestIPSetFilterFamily(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.0.0.255",
+		"+192.168.0.0-192.168.255.255",
+		"+::ffff:1.2.3.4-::ffff:1.2.3.4",
+		"+fed0::400-fed0::4ff",
+	)
+	tests := []struct {
+		s    *IPSet
+		v4   bool
+		want *IPSet
+	}{
+		{s, true, mustIPSet("+10.0.0.0-10.0.0.255", "+192.168.0.0-192.168.255.255")},
+		{s, false, mustIPSet("+::ffff:1.2.3.4-::ffff:1.2.3.4", "+fed0::400-fed0::4ff")},
+		{mustIPSet("+10.0.0.0-10.0.0.255"), false, mustIPSet()},
+		{mustIPSet("+::1-::2"), true, mustIPSet()},
+		{mustIPSet(), true, mustIPSet()},
+	}
+	for _, tt := range tests {
+		before := tt.s.String()
+		got := tt.s.FilterFamily(tt.v4)
+		if !got.Equal(tt.want) {
+			t.Errorf("(%v).FilterFamily(%v) = %v; want %v", tt.s, tt.v4, got, tt.want)
+		}
+		if after := tt.s.String(); after != before {
+			t.Errorf("FilterFamily mutated receiver: %v became %v", before, after)
+		}
+	}
+}
+
+func TestIPSetOnlyFamily(t *testing.T) {
+	tests := []struct {
+		name   string
+		s      *IPSet
+		v4, v6 bool
+	}{
+		{"v4", mustIPSet("+10.0.0.0-10.0.0.255", "+192.168.0.0-192.168.255.255"), true, false},
+		{"v6", mustIPSet("+::1-::2", "+fed0::400-fed0::4ff"), false, true},
+		{"4in6", mustIPSet("+::ffff:1.2.3.4-::ffff:1.2.3.4"), false, true},
+		{"mixed", mustIPSet("+10.0.0.0-10.0.0.255", "+::1-::2"), false, false},
+		{"empty", mustIPSet(), false, false},
+	}
+	for _, tt := range tests {
+		if got := tt.s.OnlyV4(); got != tt.v4 {
+			t.Errorf("%s: OnlyV4() = %v; want %v", tt.name, got, tt.v4)
+		}
+		if got := tt.s.OnlyV6(); got != tt.v6 {
+			t.Errorf("%s: OnlyV6() = %v; want %v", tt.name, got, tt.v6)
+		}
+	}
+}
+
+func TestParseIPSet(t *testing.T) {
+	s, err := ParseIPSet(
+		"10.0.0.0/8",
+		"10.0.0.0/16",
+		"192.168.1.10-192.168.1.20",
+		"192.168.1.21-192.168.1.30",
+		"fed0::400/120",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustIPSet(
+		"+10.0.0.0-10.255.255.255",
+		"+192.168.1.10-192.168.1.30",
+		"+fed0::400-fed0::4ff",
+	)
+	if !s.Equal(want) {
+		t.Errorf("ParseIPSet = %v; want %v", s, want)
+	}
+
+	if s, err := ParseIPSet(); err != nil || len(s.Ranges()) != 0 {
+		t.Errorf("ParseIPSet() = %v, %v; want empty set", s, err)
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "10.0.0.5-10.0.0.1", "10.0.0.1", "foo"} {
+		_, err := ParseIPSet("10.0.0.0/8", bad)
+		if err == nil {
+			t.Errorf("ParseIPSet(%q) succeeded; want error", bad)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), "entry 1: ") {
+			t.Errorf("ParseIPSet(%q) error = %q; want it to name entry 1", bad, err)
+		}
+	}
+}
+
+func TestIPSetWriteCIDRs(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.255.255.255",
+		"-10.1.2.3-10.1.2.3",
+		"+fed0::400-fed0::4ff",
+	)
+	var buf bytes.Buffer
+	n, err := s.WriteCIDRs(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want strings.Builder
+	for _, p := range s.Prefixes() {
+		fmt.Fprintf(&want, "%s\n", p)
+	}
+	if got := buf.String(); got != want.String() {
+		t.Errorf("WriteCIDRs wrote:\n%s\nwant:\n%s", got, want.String())
+	}
+	if wantN := len(s.Prefixes()); n != wantN {
+		t.Errorf("WriteCIDRs = %d; want %d", n, wantN)
+	}
+
+	w := &failingWriter{n: 3}
+	n, err = s.WriteCIDRs(w)
+	if err == nil || n != 3 {
+		t.Errorf("WriteCIDRs to failing writer = %d, %v; want 3, error", n, err)
+	}
+}
+
+func TestIPSetWriteTo(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.255.255.255",
+		"-10.1.2.3-10.1.2.3",
+		"+fed0::400-fed0::4ff",
+	)
+	var want bytes.Buffer
+	if _, err := s.WriteCIDRs(&want); err != nil {
+		t.Fatal(err)
+	}
+
+	var wt io.WriterTo = s
+	var buf bytes.Buffer
+	n, err := wt.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want.String() {
+		t.Errorf("WriteTo wrote:\n%s\nwant:\n%s", buf.String(), want.String())
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo = %d bytes; want %d", n, buf.Len())
+	}
+
+	// The first line is "10.0.0.0/16\n", 12 bytes.
+	n, err = s.WriteTo(&failingWriter{n: 1})
+	if err == nil || n != 12 {
+		t.Errorf("WriteTo to failing writer = %d, %v; want 12, error", n, err)
+	}
+}
+
+func TestIPSetAppendTo(t *testing.T) {
+	s := mustIPSet("+10.0.0.0-10.0.0.255", "+10.0.1.5-10.0.1.9", "+10.0.2.1-10.0.2.1", "+fed0::-fed0::ff")
+	// Format as nftables set elements.
+	nft := func(r IPRange) string {
+		if p, ok := r.Prefix(); ok {
+			if p.IsSingleIP() {
+				return p.Addr().String() + ", "
+			}
+			return p.String() + ", "
+		}
+		return r.String() + ", "
+	}
+	buf := []byte("elements = { ")
+	buf = s.AppendTo(buf, nft)
+	want := "elements = { 10.0.0.0/24, 10.0.1.5-10.0.1.9, 10.0.2.1, fed0::/120, "
+	if string(buf) != want {
+		t.Errorf("AppendTo = %q; want %q", buf, want)
+	}
+
+	if got := mustIPSet().AppendTo(nil, nft); len(got) != 0 {
+		t.Errorf("AppendTo of empty set = %q; want empty", got)
+	}
+}
+
+// failingWriter is an io.Writer that fails after n writes.
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errors.New("write failed")
+	}
+	w.n--
+	return len(p), nil
+}
+
+func TestIPSetCanonicalize(t *testing.T) {
+	var b IPSetBuilder
+	b.AddPrefix(mustIPPrefix("::ffff:10.0.0.0/104"))
+	s := buildIPSet(&b)
+	if s.Contains(mustIP("10.0.0.0")) {
+		t.Fatalf("%v contains 10.0.0.0 before Canonicalize", s)
+	}
+	c := s.Canonicalize()
+	if !c.Contains(mustIP("10.0.0.0")) {
+		t.Errorf("%v does not contain 10.0.0.0", c)
+	}
+	if want := mustIPSet("+10.0.0.0-10.255.255.255"); !c.Equal(want) {
+		t.Errorf("Canonicalize() = %v; want %v", c, want)
+	}
+	if again := c.Canonicalize(); !again.Equal(c) {
+		t.Errorf("Canonicalize() not idempotent: %v became %v", c, again)
+	}
+
+	tests := []struct {
+		s, want *IPSet
+	}{
+		{mustIPSet(), mustIPSet()},
+		{
+			mustIPSet("+10.0.0.0-10.0.0.255", "+fed0::400-fed0::4ff"),
+			mustIPSet("+10.0.0.0-10.0.0.255", "+fed0::400-fed0::4ff"),
+		},
+		{
+			// Overlapping IPv4 and IPv4-mapped ranges merge.
+			mustIPSet("+10.0.0.0-10.0.0.255", "+::ffff:10.0.0.128-::ffff:10.0.1.255"),
+			mustIPSet("+10.0.0.0-10.0.1.255"),
+		},
+		{
+			// An IPv6 range straddling the mapped block is split.
+			mustIPSet("+::fffe:ffff:ffff-::ffff:0.0.0.255"),
+			mustIPSet("+0.0.0.0-0.0.0.255", "+::fffe:ffff:ffff-::fffe:ffff:ffff"),
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.s.Canonicalize(); !got.Equal(tt.want) {
+			t.Errorf("(%v).Canonicalize() = %v; want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestIPSetRemoveFreePrefixFrom(t *testing.T) {
+	var b IPSetBuilder
+	b.AddPrefix(mustIPPrefix("10.0.0.0/16"))
+	b.RemovePrefix(mustIPPrefix("10.0.0.0/24"))
+	b.RemovePrefix(mustIPPrefix("10.0.128.0/24"))
+	b.RemovePrefix(mustIPPrefix("10.0.255.0/24"))
+	s := buildIPSet(&b)
+
+	tests := []struct {
+		bits    uint8
+		highest bool
+		want    IPPrefix
+		wantOK  bool
+	}{
+		{24, false, mustIPPrefix("10.0.1.0/24"), true},
+		{24, true, mustIPPrefix("10.0.254.0/24"), true},
+		{23, false, mustIPPrefix("10.0.2.0/23"), true},
+		{23, true, mustIPPrefix("10.0.252.0/23"), true},
+		{18, false, mustIPPrefix("10.0.64.0/18"), true},
+		{18, true, mustIPPrefix("10.0.64.0/18"), true},
+		{17, false, IPPrefix{}, false},
+		{33, false, IPPrefix{}, false},
+	}
+	for _, tt := range tests {
+		got, newSet, ok := s.RemoveFreePrefixFrom(tt.bits, tt.highest)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("RemoveFreePrefixFrom(%d, %v) = %v, %v; want %v, %v", tt.bits, tt.highest, got, ok, tt.want, tt.wantOK)
+			continue
+		}
+		if !ok {
+			if newSet != s {
+				t.Errorf("RemoveFreePrefixFrom(%d, %v) returned a different set when not ok", tt.bits, tt.highest)
+			}
+			continue
+		}
+		var wb IPSetBuilder
+		wb.AddSet(s)
+		wb.RemovePrefix(tt.want)
+		if want := buildIPSet(&wb); !newSet.Equal(want) {
+			t.Errorf("RemoveFreePrefixFrom(%d, %v) new set = %v; want %v", tt.bits, tt.highest, newSet, want)
+		}
+	}
+
+	v6 := mustIPSet("+10.0.0.0-10.0.0.255", "+fed0::-fed0::ffff")
+	if got, _, _ := v6.RemoveFreePrefixFrom(120, false); got != mustIPPrefix("fed0::/120") {
+		t.Errorf("RemoveFreePrefixFrom(120, false) = %v; want fed0::/120", got)
+	}
+	if got, _, _ := v6.RemoveFreePrefixFrom(28, true); got != mustIPPrefix("10.0.0.240/28") {
+		t.Errorf("RemoveFreePrefixFrom(28, true) = %v; want 10.0.0.240/28", got)
+	}
+}
+
+func TestIPSetFreePrefixes(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.0.3.255",   // four /24s
+		"-10.0.1.0-10.0.1.0",     // minus one address
+		"+10.0.8.128-10.0.9.127", // straddles two /24s, contains neither
+		"+10.0.255.0-10.0.255.255",
+		"+255.255.255.0-255.255.255.255",
+		"+fed0::-fed0::1ff",
+	)
+	tests := []struct {
+		bits uint8
+		want []IPPrefix
+	}{
+		{24, pxv("10.0.0.0/24", "10.0.2.0/24", "10.0.3.0/24", "10.0.255.0/24", "255.255.255.0/24")},
+		{23, pxv("10.0.2.0/23")},
+		{22, nil},
+		{25, pxv(
+			"10.0.0.0/25", "10.0.0.128/25",
+			"10.0.1.128/25",
+			"10.0.2.0/25", "10.0.2.128/25",
+			"10.0.3.0/25", "10.0.3.128/25",
+			"10.0.8.128/25",
+			"10.0.9.0/25",
+			"10.0.255.0/25", "10.0.255.128/25",
+			"255.255.255.0/25", "255.255.255.128/25",
+		)},
+		{120, pxv("fed0::/120", "fed0::100/120")},
+	}
+	for _, tt := range tests {
+		got := s.FreePrefixes(tt.bits)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FreePrefixes(%d) = %v; want %v", tt.bits, got, tt.want)
+		}
+		for _, p := range got {
+			if !s.ContainsPrefix(p) {
+				t.Errorf("FreePrefixes(%d) returned %v, not contained in set", tt.bits, p)
+			}
+		}
+	}
+}
+
+func TestIPSetLargestFreePrefix(t *testing.T) {
+	tests := []struct {
+		s      *IPSet
+		want   IPPrefix
+		wantOK bool
+	}{
+		{
+			// 1,512 free addresses, but no block larger than a /23.
+			mustIPSet(
+				"+10.0.0.0-10.0.0.255",
+				"+10.0.1.128-10.0.3.255",
+				"+10.0.4.0-10.0.4.103",
+				"+10.0.7.0-10.0.8.255",
+			),
+			mustIPPrefix("10.0.2.0/23"), true,
+		},
+		{
+			// Equally large blocks: the lowest wins.
+			mustIPSet("+10.0.0.128-10.0.0.255", "+10.0.1.0-10.0.1.63", "+10.0.2.0-10.0.2.127"),
+			mustIPPrefix("10.0.0.128/25"), true,
+		},
+		{
+			// Sizes are compared across families by address count.
+			mustIPSet("+10.0.0.0-10.0.255.255", "+fed0::-fed0::ff"),
+			mustIPPrefix("10.0.0.0/16"), true,
+		},
+		{
+			mustIPSet("+10.0.0.0-10.0.255.255", "+fed0::-fed0::ffff:ffff"),
+			mustIPPrefix("fed0::/96"), true,
+		},
+		{mustIPSet(), IPPrefix{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.s.LargestFreePrefix()
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("(%v).LargestFreePrefix() = %v, %v; want %v, %v", tt.s, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestIPSetDenseRegions(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.0.0.255",   // full
+		"+10.0.1.0-10.0.1.63",    // half, in two ranges
+		"+10.0.1.192-10.0.1.255", //
+		"+10.0.2.7-10.0.2.9",     // sparse
+		"+10.0.4.0-10.0.5.127",   // full /24 then half /24
+		"+fed0::-fed0::3f",       // quarter
+	)
+	tests := []struct {
+		minDensity float64
+		bits       uint8
+		want       []IPPrefix
+	}{
+		{1, 24, pxv("10.0.0.0/24", "10.0.4.0/24")},
+		{0.5, 24, pxv("10.0.0.0/24", "10.0.1.0/24", "10.0.4.0/24", "10.0.5.0/24")},
+		{0.51, 24, pxv("10.0.0.0/24", "10.0.4.0/24")},
+		{0.01, 24, pxv("10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24", "10.0.4.0/24", "10.0.5.0/24")},
+		{0, 24, pxv("10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24", "10.0.4.0/24", "10.0.5.0/24", "fed0::/24")},
+		{0.5, 23, pxv("10.0.0.0/23", "10.0.4.0/23")},
+		{0.375, 22, pxv("10.0.0.0/22", "10.0.4.0/22")},
+		{0.376, 22, pxv("10.0.0.0/22")},
+		{0.25, 120, pxv("fed0::/120")},
+		{0.26, 120, nil},
+		{0.5, 121, pxv("fed0::/121")},
+	}
+	for _, tt := range tests {
+		if got := s.DenseRegions(tt.minDensity, tt.bits); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("DenseRegions(%v, %d) = %v; want %v", tt.minDensity, tt.bits, got, tt.want)
+		}
+	}
+
+	full := mustIPSet("+::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")
+	if got := full.DenseRegions(1, 0); !reflect.DeepEqual(got, pxv("::/0")) {
+		t.Errorf("DenseRegions(1, 0) of all IPv6 = %v; want [::/0]", got)
+	}
+}
+
+func TestIPSetCountPrefixes(t *testing.T) {
+	tests := []*IPSet{
+		mustIPSet(),
+		mustIPSet("+10.0.0.0-10.255.255.255"),
+		mustIPSet("+10.0.0.0-10.255.255.255", "-10.1.2.3-10.1.2.3"),
+		mustIPSet("+1.2.3.5-5.6.7.8", "+fed0::400-fed0::4ff", "+::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe"),
+		mustIPSet("+0.0.0.0-255.255.255.255"),
+	}
+	for _, s := range tests {
+		if got, want := s.CountPrefixes(), len(s.Prefixes()); got != want {
+			t.Errorf("(%v).CountPrefixes() = %d; want %d", s, got, want)
+		}
+	}
+	if n := mustIPSet("+10.0.0.0-10.255.255.255", "-10.1.2.3-10.1.2.3").CountPrefixes(); n != 24 {
+		t.Errorf("CountPrefixes of 10.0.0.0/8 minus 10.1.2.3/32 = %d; want 24", n)
+	}
+
+	s := tests[2]
+	if allocs := testing.AllocsPerRun(100, func() { sinkInt = s.CountPrefixes() }); allocs != 0 {
+		t.Errorf("CountPrefixes allocs = %v; want 0", allocs)
+	}
+}
+
+func TestIPSetRangesFamily(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.0.0.255",
+		"+192.168.0.0-192.168.255.255",
+		"+::ffff:1.2.3.4-::ffff:1.2.3.4",
+		"+fed0::400-fed0::4ff",
+	)
+	tests := []struct {
+		s    *IPSet
+		v4   bool
+		want []IPRange
+	}{
+		{s, true, []IPRange{MustParseIPRange("10.0.0.0-10.0.0.255"), MustParseIPRange("192.168.0.0-192.168.255.255")}},
+		{s, false, []IPRange{MustParseIPRange("::ffff:1.2.3.4-::ffff:1.2.3.4"), MustParseIPRange("fed0::400-fed0::4ff")}},
+		{mustIPSet("+10.0.0.0-10.0.0.255"), false, []IPRange{}},
+		{mustIPSet(), true, []IPRange{}},
+	}
+	for _, tt := range tests {
+		if got := tt.s.RangesFamily(tt.v4); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("(%v).RangesFamily(%v) = %v; want %v", tt.s, tt.v4, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkIPSetBuilder(b *testing.B) {
+	const n = 1000
+	pfxs := make([]IPPrefix, n)
+	for i := range pfxs {
+		pfxs[i] = netip.PrefixFrom(IPv4(10, uint8(i>>8), uint8(i), 0), 24)
+	}
+	rand.Shuffle(len(pfxs), func(i, j int) { pfxs[i], pfxs[j] = pfxs[j], pfxs[i] })
+
+	b.Run("bulk", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var sb IPSetBuilder
+			for _, p := range pfxs {
+				sb.AddPrefix(p)
+			}
+			buildIPSet(&sb)
+		}
+	})
+	b.Run("normalize-each", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var sb IPSetBuilder
+			for _, p := range pfxs {
+				sb.AddPrefix(p)
+				buildIPSet(&sb)
+			}
+		}
+	})
+}
+
+func TestIPSetBuilderGrow(t *testing.T) {
+	var b IPSetBuilder
+	b.Add(mustIP("1.2.3.4"))
+	b.Grow(100)
+	if got := cap(b.in) - len(b.in); got < 100 {
+		t.Errorf("after Grow(100), spare capacity = %d; want >= 100", got)
+	}
+	in := &b.in[0]
+	for i := 0; i < 100; i++ {
+		b.Add(IPv4(10, 0, 0, uint8(i)))
+	}
+	if &b.in[0] != in {
+		t.Error("adding 100 IPs after Grow(100) reallocated")
+	}
+	want := mustIPSet("+1.2.3.4-1.2.3.4", "+10.0.0.0-10.0.0.99")
+	if got := buildIPSet(&b); !got.Equal(want) {
+		t.Errorf("set = %v; want %v", got, want)
+	}
+}
+
+func BenchmarkIPSetBuilderGrow(b *testing.B) {
+	const n = 1000
+	pfxs := make([]IPPrefix, n)
+	for i := range pfxs {
+		pfxs[i] = netip.PrefixFrom(IPv4(10, uint8(i>>8), uint8(i), 0), 24)
+	}
+	b.Run("NoGrow", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var sb IPSetBuilder
+			for _, p := range pfxs {
+				sb.AddPrefix(p)
+			}
+			buildIPSet(&sb)
+		}
+	})
+	b.Run("Grow", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var sb IPSetBuilder
+			sb.Grow(len(pfxs))
+			for _, p := range pfxs {
+				sb.AddPrefix(p)
+			}
+			buildIPSet(&sb)
+		}
+	})
+}
+
+func BenchmarkIPSetBuilderAddIPs(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	ips := make([]IP, 1000)
+	for i := range ips {
+		ips[i] = IPv4(10, uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)))
+	}
+	b.Run("Add", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var s IPSetBuilder
+			for _, ip := range ips {
+				s.Add(ip)
+			}
+			buildIPSet(&s)
+		}
+	})
+	b.Run("AddIPs", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var s IPSetBuilder
+			s.AddIPs(ips)
+			buildIPSet(&s)
+		}
+	})
+}
+
+func TestIPSetOverlapsPrefix(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.0.0.255",
+		"+10.0.2.128-10.0.3.127",
+		"+fed0::400-fed0::4ff",
+	)
+	tests := []struct {
+		p    IPPrefix
+		want bool
+	}{
+		{mustIPPrefix("10.0.0.0/24"), true},    // exact match
+		{mustIPPrefix("10.0.0.64/26"), true},   // fully contained
+		{mustIPPrefix("10.0.0.0/16"), true},    // contains set ranges
+		{mustIPPrefix("10.0.2.0/24"), true},    // partial overlap at end of prefix
+		{mustIPPrefix("10.0.3.0/24"), true},    // partial overlap at start of prefix
+		{mustIPPrefix("10.0.1.0/24"), false},   // between ranges
+		{mustIPPrefix("10.0.2.0/25"), false},   // adjacent to start of range
+		{mustIPPrefix("10.0.3.128/25"), false}, // adjacent to end of range
+		{mustIPPrefix("9.0.0.0/8"), false},     // before all ranges
+		{mustIPPrefix("11.0.0.0/8"), false},    // after IPv4 ranges
+		{mustIPPrefix("fed0::4f0/124"), true},  // IPv6
+		{mustIPPrefix("fed0::500/120"), false}, // IPv6, after all ranges
+		{mustIPPrefix("::ffff:10.0.0.0/120"), false},
+		{IPPrefix{}, false},
+	}
+	for _, tt := range tests {
+		if got := s.OverlapsPrefix(tt.p); got != tt.want {
+			t.Errorf("OverlapsPrefix(%v) = %v; want %v", tt.p, got, tt.want)
+		}
+	}
+	if mustIPSet().OverlapsPrefix(mustIPPrefix("0.0.0.0/0")) {
+		t.Error("empty set overlaps 0.0.0.0/0")
+	}
+}
+
+func TestIPSetOverlapsRange(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.10-10.0.0.20",
+		"+10.0.0.40-10.0.0.50",
+		"+fed0::400-fed0::4ff",
+	)
+	tests := []struct {
+		r    string
+		want bool
+	}{
+		{"10.0.0.12-10.0.0.18", true},   // interior
+		{"10.0.0.0-10.0.0.255", true},   // covers everything
+		{"10.0.0.10-10.0.0.10", true},   // first address
+		{"10.0.0.20-10.0.0.20", true},   // last address
+		{"10.0.0.5-10.0.0.10", true},    // boundary overlap at start
+		{"10.0.0.20-10.0.0.25", true},   // boundary overlap at end
+		{"10.0.0.25-10.0.0.45", true},   // overlaps second range only
+		{"10.0.0.0-10.0.0.9", false},    // adjacent to start
+		{"10.0.0.21-10.0.0.39", false},  // adjacent to both ranges
+		{"10.0.0.51-10.0.0.255", false}, // adjacent to end
+		{"0.0.0.0-10.0.0.9", false},     // before everything
+		{"fed0::-fed0::3ff", false},     // adjacent IPv6
+		{"fed0::4ff-fed0::500", true},   // boundary IPv6
+		{"::ffff:10.0.0.10-::ffff:10.0.0.20", false},
+	}
+	for _, tt := range tests {
+		r := MustParseIPRange(tt.r)
+		if got := s.OverlapsRange(r); got != tt.want {
+			t.Errorf("OverlapsRange(%v) = %v; want %v", r, got, tt.want)
+		}
+	}
+	if s.OverlapsRange(IPRange{}) {
+		t.Error("OverlapsRange(IPRange{}) = true; want false")
+	}
+}
+
+func TestParseIPSetFromReader(t *testing.T) {
+	const in = `# Allowlist
+10.0.0.0/8
+
+  192.168.1.10-192.168.1.20   # office
+192.168.1.21-192.168.1.30
+	# IPv6
+fed0::400/120
+`
+	s, err := ParseIPSetFromReader(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustIPSet(
+		"+10.0.0.0-10.255.255.255",
+		"+192.168.1.10-192.168.1.30",
+		"+fed0::400-fed0::4ff",
+	)
+	if !s.Equal(want) {
+		t.Errorf("ParseIPSetFromReader = %v; want %v", s, want)
+	}
+
+	s, err = ParseIPSetFromReader(strings.NewReader("# nothing\n\n"))
+	if err != nil || !s.Equal(mustIPSet()) {
+		t.Errorf("ParseIPSetFromReader of comments only = %v, %v; want empty set", s, err)
+	}
+
+	_, err = ParseIPSetFromReader(strings.NewReader("# header\n10.0.0.0/8\n\n10.0.0.0/33\n1.2.3.4/32\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 4: ") {
+		t.Errorf("ParseIPSetFromReader error = %v; want error on line 4", err)
+	}
+
+	wantErr := errors.New("read failed")
+	_, err = ParseIPSetFromReader(io.MultiReader(strings.NewReader("10.0.0.0/8\n"), iotest.ErrReader(wantErr)))
+	if err != wantErr {
+		t.Errorf("ParseIPSetFromReader error = %v; want %v", err, wantErr)
+	}
+}
+
+func TestIPSetBuilderReadFrom(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.255.255.255",
+		"-10.1.2.3-10.1.2.3",
+		"+fed0::400-fed0::4ff",
+	)
+	var buf bytes.Buffer
+	written, err := s.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b IPSetBuilder
+	var rf io.ReaderFrom = &b
+	read, err := rf.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != written {
+		t.Errorf("ReadFrom read %d bytes; WriteTo wrote %d", read, written)
+	}
+	if got := buildIPSet(&b); !got.Equal(s) {
+		t.Errorf("round trip = %v; want %v", got, s)
+	}
+
+	// Comments and blank lines, added to the existing contents.
+	const in = "# more\n\n  192.168.0.0/24 # lab\n"
+	n, err := b.ReadFrom(strings.NewReader(in))
+	if err != nil || n != int64(len(in)) {
+		t.Errorf("ReadFrom = %d, %v; want %d, nil", n, err, len(in))
+	}
+	want := mustIPSet(
+		"+10.0.0.0-10.255.255.255",
+		"-10.1.2.3-10.1.2.3",
+		"+fed0::400-fed0::4ff",
+		"+192.168.0.0-192.168.0.255",
+	)
+	if got := buildIPSet(&b); !got.Equal(want) {
+		t.Errorf("after second ReadFrom = %v; want %v", got, want)
+	}
+
+	var bad IPSetBuilder
+	_, err = bad.ReadFrom(strings.NewReader("1.2.3.4/32\nfoo\n5.6.7.8/32\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2: ") {
+		t.Errorf("ReadFrom error = %v; want error on line 2", err)
+	}
+	if got, want := buildIPSet(&bad), mustIPSet("+1.2.3.4-1.2.3.4"); !got.Equal(want) {
+		t.Errorf("after failed ReadFrom = %v; want %v", got, want)
+	}
+}
+
+func TestParseIPSetCSV(t *testing.T) {
+	const in = `from,to
+10.0.0.0,10.255.255.255
+192.168.1.10, 192.168.1.20
+"192.168.1.21","192.168.1.30"
+fed0::400,fed0::4ff
+`
+	s, err := ParseIPSetCSV(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustIPSet(
+		"+10.0.0.0-10.255.255.255",
+		"+192.168.1.10-192.168.1.30",
+		"+fed0::400-fed0::4ff",
+	)
+	if !s.Equal(want) {
+		t.Errorf("ParseIPSetCSV = %v; want %v", s, want)
+	}
+
+	// No header.
+	s, err = ParseIPSetCSV(strings.NewReader("1.2.3.4,1.2.3.5\n"))
+	if want := mustIPSet("+1.2.3.4-1.2.3.5"); err != nil || !s.Equal(want) {
+		t.Errorf("ParseIPSetCSV without header = %v, %v; want %v", s, err, want)
+	}
+
+	s, err = ParseIPSetCSV(strings.NewReader(""))
+	if err != nil || !s.Equal(mustIPSet()) {
+		t.Errorf("ParseIPSetCSV of empty input = %v, %v; want empty set", s, err)
+	}
+
+	for _, tt := range []struct {
+		in, wantErr string
+	}{
+		{"from,to\n10.0.0.0,10.0.0.255\n10.0.1.0,foo\n", `row 3: invalid To IP "foo"`},
+		{"10.0.0.0,10.0.0.255\nfrom,to\n", `row 2: invalid From IP "from"`},
+		{"10.0.0.x,10.0.0.5\n10.0.1.0,10.0.1.5\n", `row 1: invalid From IP "10.0.0.x"`},
+		{"10.0.0.0,10.0.0.x\n10.0.1.0,10.0.1.5\n", `row 1: invalid To IP "10.0.0.x"`},
+		{"10.0.0.9,10.0.0.1\n", "row 1: range 10.0.0.9 to 10.0.0.1 not valid"},
+		{"10.0.0.0,::1\n", "row 1: range 10.0.0.0 to ::1 not valid"},
+		{"from,to\n10.0.0.0,10.0.0.255,extra\n", "row 2: got 3 fields, want 2"},
+	} {
+		_, err := ParseIPSetCSV(strings.NewReader(tt.in))
+		if err == nil || err.Error() != tt.wantErr {
+			t.Errorf("ParseIPSetCSV(%q) error = %v; want %q", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIPSetInvert(t *testing.T) {
+	tests := []struct {
+		s, want *IPSet
+	}{
+		{
+			mustIPSet("+10.1.2.0-10.1.2.255"),
+			mustIPSet("+0.0.0.0-10.1.1.255", "+10.1.3.0-255.255.255.255"),
+		},
+		{
+			mustIPSet("+0.0.0.0-0.0.0.255", "+fed0::-fed0::ffff"),
+			mustIPSet(
+				"+0.0.1.0-255.255.255.255",
+				"+::-fecf:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+				"+fed0::1:0-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+			),
+		},
+		{
+			mustIPSet("+0.0.0.0-255.255.255.255"),
+			mustIPSet(),
+		},
+		{
+			mustIPSet(),
+			mustIPSet(),
+		},
+	}
+	for _, tt := range tests {
+		got := tt.s.Invert()
+		if !got.Equal(tt.want) {
+			t.Errorf("(%v).Invert() = %v; want %v", tt.s, got, tt.want)
+		}
+		if got.Overlaps(tt.s) {
+			t.Errorf("(%v).Invert() = %v overlaps original", tt.s, got)
+		}
+	}
+}
+
+func TestIPSetExpandIPs(t *testing.T) {
+	tests := []struct {
+		s             *IPSet
+		limit         int
+		want          []IP
+		wantTruncated bool
+	}{
+		{mustIPSet("+10.0.0.0-10.0.0.3"), 10, mustIPs("10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3"), false},
+		{mustIPSet("+10.0.0.0-10.0.0.3"), 4, mustIPs("10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3"), false},
+		{mustIPSet("+10.0.0.0-10.0.0.3"), 3, mustIPs("10.0.0.0", "10.0.0.1", "10.0.0.2"), true},
+		{
+			mustIPSet("+10.0.0.0-10.255.255.255", "+1.2.3.255-1.2.4.0"),
+			4,
+			mustIPs("1.2.3.255", "1.2.4.0", "10.0.0.0", "10.0.0.1"),
+			true,
+		},
+		{
+			mustIPSet("+255.255.255.254-255.255.255.255", "+::-::1", "+ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"),
+			10,
+			mustIPs("255.255.255.254", "255.255.255.255", "::", "::1", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"),
+			false,
+		},
+		{mustIPSet("+::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), 2, mustIPs("::", "::1"), true},
+		{mustIPSet("+10.0.0.0-10.0.0.3"), 0, nil, true},
+		{mustIPSet(), 10, nil, false},
+	}
+	for _, tt := range tests {
+		got, truncated := tt.s.ExpandIPs(tt.limit)
+		if !reflect.DeepEqual(got, tt.want) || truncated != tt.wantTruncated {
+			t.Errorf("(%v).ExpandIPs(%d) = %v, %v; want %v, %v", tt.s, tt.limit, got, truncated, tt.want, tt.wantTruncated)
+		}
+	}
+}
+
+func TestIPSetRandomIP(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	if ip, ok := mustIPSet().RandomIP(rnd); ok {
+		t.Errorf("empty set RandomIP = %v, true; want false", ip)
+	}
+
+	// Three ranges of 256, 768 and 1024 addresses.
+	s := mustIPSet(
+		"+10.0.0.0-10.0.0.255",
+		"+10.1.0.0-10.1.2.255",
+		"+fed0::-fed0::3ff",
+	)
+	ranges := s.Ranges()
+	const n = 20000
+	var counts [3]int
+	for i := 0; i < n; i++ {
+		ip, ok := s.RandomIP(rnd)
+		if !ok {
+			t.Fatal("RandomIP not ok")
+		}
+		found := false
+		for j, r := range ranges {
+			if r.Contains(ip) {
+				counts[j]++
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("RandomIP = %v, not in %v", ip, s)
+		}
+	}
+	for i, want := range []float64{0.125, 0.375, 0.5} {
+		if got := float64(counts[i]) / n; math.Abs(got-want) > 0.02 {
+			t.Errorf("range %v chosen %.3f of the time; want about %.3f", ranges[i], got, want)
+		}
+	}
+
+	// Ranges too large for a uint64 work, and every address can be chosen.
+	all := mustIPSet("+::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")
+	var hi, lo int
+	for i := 0; i < 1000; i++ {
+		ip, _ := all.RandomIP(rnd)
+		if ip.As16()[0]&0x80 != 0 {
+			hi++
+		} else {
+			lo++
+		}
+	}
+	if hi < 400 || lo < 400 {
+		t.Errorf("RandomIP over ::/0 chose %d high and %d low addresses; want roughly even", hi, lo)
+	}
+}
+
+func TestIPSetPrefixesSortedByLen(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.0.2.255",
+		"+10.0.4.1-10.0.4.1",
+		"+192.168.0.0-192.168.0.255",
+		"+fed0::400-fed0::4ff",
+		"+fed0::-fed0::1",
+	)
+	got := s.PrefixesSortedByLen()
+	want := pxv(
+		"fed0::/127",
+		"fed0::400/120",
+		"10.0.4.1/32",
+		"10.0.2.0/24",
+		"192.168.0.0/24",
+		"10.0.0.0/23",
+	)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PrefixesSortedByLen() = %v; want %v", got, want)
+	}
+
+	sortedAgain := append([]IPPrefix(nil), s.Prefixes()...)
+	sort.Slice(sortedAgain, func(i, j int) bool { return sortedAgain[i].String() < sortedAgain[j].String() })
+	gotSorted := append([]IPPrefix(nil), got...)
+	sort.Slice(gotSorted, func(i, j int) bool { return gotSorted[i].String() < gotSorted[j].String() })
+	if !reflect.DeepEqual(gotSorted, sortedAgain) {
+		t.Errorf("PrefixesSortedByLen() has prefixes %v; Prefixes() has %v", gotSorted, sortedAgain)
+	}
+}
+
+func TestIPSetDiff(t *testing.T) {
+	rr := func(ranges ...string) []IPRange {
+		out := []IPRange{}
+		for _, r := range ranges {
+			out = append(out, MustParseIPRange(r))
+		}
+		return out
+	}
+	tests := []struct {
+		name           string
+		old, new       *IPSet
+		added, removed []IPRange
+	}{
+		{
+			name:    "unchanged",
+			old:     mustIPSet("+10.0.0.0-10.0.0.255"),
+			new:     mustIPSet("+10.0.0.0-10.0.0.255"),
+			added:   rr(),
+			removed: rr(),
+		},
+		{
+			name:    "entry_added",
+			old:     mustIPSet("+10.0.0.0-10.0.0.255"),
+			new:     mustIPSet("+10.0.0.0-10.0.0.255", "+fed0::-fed0::ff"),
+			added:   rr("fed0::-fed0::ff"),
+			removed: rr(),
+		},
+		{
+			name:    "entry_removed",
+			old:     mustIPSet("+10.0.0.0-10.0.0.255", "+192.168.0.0-192.168.0.255"),
+			new:     mustIPSet("+192.168.0.0-192.168.0.255"),
+			added:   rr(),
+			removed: rr("10.0.0.0-10.0.0.255"),
+		},
+		{
+			name:    "grown",
+			old:     mustIPSet("+10.0.0.10-10.0.0.20"),
+			new:     mustIPSet("+10.0.0.0-10.0.0.30"),
+			added:   rr("10.0.0.0-10.0.0.9", "10.0.0.21-10.0.0.30"),
+			removed: rr(),
+		},
+		{
+			name:    "shrunk",
+			old:     mustIPSet("+10.0.0.0-10.0.0.30"),
+			new:     mustIPSet("+10.0.0.10-10.0.0.20"),
+			added:   rr(),
+			removed: rr("10.0.0.0-10.0.0.9", "10.0.0.21-10.0.0.30"),
+		},
+		{
+			name:    "shifted",
+			old:     mustIPSet("+10.0.0.0-10.0.0.20"),
+			new:     mustIPSet("+10.0.0.10-10.0.0.30"),
+			added:   rr("10.0.0.21-10.0.0.30"),
+			removed: rr("10.0.0.0-10.0.0.9"),
+		},
+	}
+	for _, tt := range tests {
+		added, removed := tt.new.Diff(tt.old)
+		if !reflect.DeepEqual(added, tt.added) {
+			t.Errorf("%s: added = %v; want %v", tt.name, added, tt.added)
+		}
+		if !reflect.DeepEqual(removed, tt.removed) {
+			t.Errorf("%s: removed = %v; want %v", tt.name, removed, tt.removed)
+		}
+	}
+}
+
+func TestIPSetPlusMinusAnd(t *testing.T) {
+	a := mustIPSet("+10.0.0.0-10.0.0.255")
+	b := mustIPSet("+10.0.1.0-10.0.1.255", "+fed0::-fed0::ff")
+	c := mustIPSet("+10.0.0.128-10.0.1.127", "+fed0::80-fed0::ff")
+	aRanges, bRanges, cRanges := a.Ranges(), b.Ranges(), c.Ranges()
+
+	tests := []struct {
+		name      string
+		got, want *IPSet
+	}{
+		{"a+b", a.Plus(b), mustIPSet("+10.0.0.0-10.0.1.255", "+fed0::-fed0::ff")},
+		{"a-c", a.Minus(c), mustIPSet("+10.0.0.0-10.0.0.127")},
+		{"a&c", a.And(c), mustIPSet("+10.0.0.128-10.0.0.255")},
+		{"a+b-c", a.Plus(b).Minus(c), mustIPSet("+10.0.0.0-10.0.0.127", "+10.0.1.128-10.0.1.255", "+fed0::-fed0::7f")},
+		{"(a+b)&c", a.Plus(b).And(c), c},
+		{"a-a", a.Minus(a), mustIPSet()},
+		{"a&b", a.And(b), mustIPSet()},
+		{"a+empty", a.Plus(mustIPSet()), a},
+	}
+	for _, tt := range tests {
+		if !tt.got.Equal(tt.want) {
+			t.Errorf("%s = %v; want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		s    *IPSet
+		want []IPRange
+	}{{a, aRanges}, {b, bRanges}, {c, cRanges}} {
+		if got := tt.s.Ranges(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("input modified: %v; want %v", got, tt.want)
+		}
+	}
+}
+
+func TestIPSetSymmetricDifference(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b *IPSet
+		want *IPSet
+	}{
+		{
+			name: "partial_overlap",
+			a:    mustIPSet("+10.0.0.0-10.0.0.20"),
+			b:    mustIPSet("+10.0.0.10-10.0.0.30"),
+			want: mustIPSet("+10.0.0.0-10.0.0.9", "+10.0.0.21-10.0.0.30"),
+		},
+		{
+			name: "contained",
+			a:    mustIPSet("+10.0.0.0-10.0.0.255", "+fed0::-fed0::ff"),
+			b:    mustIPSet("+10.0.0.10-10.0.0.20", "+fed0::-fed0::ff"),
+			want: mustIPSet("+10.0.0.0-10.0.0.9", "+10.0.0.21-10.0.0.255"),
+		},
+		{
+			name: "equal",
+			a:    mustIPSet("+10.0.0.0-10.0.0.255"),
+			b:    mustIPSet("+10.0.0.0-10.0.0.255"),
+			want: mustIPSet(),
+		},
+		{
+			name: "disjoint",
+			a:    mustIPSet("+10.0.0.0-10.0.0.255"),
+			b:    mustIPSet("+10.0.1.0-10.0.1.255", "+fed0::-fed0::ff"),
+			want: mustIPSet("+10.0.0.0-10.0.1.255", "+fed0::-fed0::ff"),
+		},
+		{
+			name: "empty",
+			a:    mustIPSet(),
+			b:    mustIPSet("+10.0.0.0-10.0.0.255"),
+			want: mustIPSet("+10.0.0.0-10.0.0.255"),
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.a.SymmetricDifference(tt.b); !got.Equal(tt.want) {
+			t.Errorf("%s: a.SymmetricDifference(b) = %v; want %v", tt.name, got, tt.want)
+		}
+		if got := tt.b.SymmetricDifference(tt.a); !got.Equal(tt.want) {
+			t.Errorf("%s: b.SymmetricDifference(a) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	randSet := func() *IPSet {
+		var sb IPSetBuilder
+		for i := 0; i < 1+rnd.Intn(8); i++ {
+			lo := uint8(rnd.Intn(256))
+			hi := lo + uint8(rnd.Intn(int(255-lo)+1))
+			sb.AddRange(IPRangeFrom(IPv4(10, 0, 0, lo), IPv4(10, 0, 0, hi)))
+		}
+		if rnd.Intn(2) == 0 {
+			sb.Add(mustIP(fmt.Sprintf("fed0::%x", rnd.Intn(4))))
+		}
+		ret, _ := sb.IPSet()
+		return ret
+	}
+	for i := 0; i < 500; i++ {
+		a, b := randSet(), randSet()
+		want := a.Minus(b).Plus(b.Minus(a))
+		if got := a.SymmetricDifference(b); !got.Equal(want) || !reflect.DeepEqual(got.Ranges(), want.Ranges()) {
+			t.Fatalf("SymmetricDifference(%v, %v) = %v; want %v", a.Ranges(), b.Ranges(), got.Ranges(), want.Ranges())
+		}
+	}
+}
+
+func TestIPSetTrimTo(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.0.0.20",
+		"+10.0.0.30-10.0.0.40",
+		"+10.0.0.50-10.0.0.60",
+		"+10.0.0.70-10.0.0.80",
+		"+fed0::-fed0::ff",
+	)
+	tests := []struct {
+		bounds IPRange
+		want   *IPSet
+	}{
+		{
+			// Straddles a range at each end.
+			MustParseIPRange("10.0.0.10-10.0.0.55"),
+			mustIPSet("+10.0.0.10-10.0.0.20", "+10.0.0.30-10.0.0.40", "+10.0.0.50-10.0.0.55"),
+		},
+		{
+			// Ends in gaps.
+			MustParseIPRange("10.0.0.25-10.0.0.65"),
+			mustIPSet("+10.0.0.30-10.0.0.40", "+10.0.0.50-10.0.0.60"),
+		},
+		{
+			// Inside a single range.
+			MustParseIPRange("10.0.0.32-10.0.0.35"),
+			mustIPSet("+10.0.0.32-10.0.0.35"),
+		},
+		{MustParseIPRange("10.0.0.21-10.0.0.29"), mustIPSet()},
+		{MustParseIPRange("0.0.0.0-255.255.255.255"), s.FilterFamily(true)},
+		{MustParseIPRange("fed0::80-fed0::1:0"), mustIPSet("+fed0::80-fed0::ff")},
+		{IPRange{}, mustIPSet()},
+	}
+	for _, tt := range tests {
+		if got := s.TrimTo(tt.bounds); !got.Equal(tt.want) {
+			t.Errorf("TrimTo(%v) = %v; want %v", tt.bounds, got, tt.want)
+		}
+	}
+}
+
+func TestIPSetEqualContent(t *testing.T) {
+	tests := []struct {
+		a, b      *IPSet
+		equal     bool
+		equalCont bool
+	}{
+		{
+			mustIPSet("+10.0.0.0-10.0.0.255", "+fed0::-fed0::ff"),
+			mustIPSet("+::ffff:10.0.0.0-::ffff:10.0.0.255", "+fed0::-fed0::ff"),
+			false, true,
+		},
+		{
+			// Split across both representations.
+			mustIPSet("+10.0.0.0-10.0.0.127", "+::ffff:10.0.0.128-::ffff:10.0.0.255"),
+			mustIPSet("+10.0.0.0-10.0.0.255"),
+			false, true,
+		},
+		{
+			mustIPSet("+10.0.0.0-10.0.0.255"),
+			mustIPSet("+10.0.0.0-10.0.0.255"),
+			true, true,
+		},
+		{
+			mustIPSet("+10.0.0.0-10.0.0.255"),
+			mustIPSet("+::ffff:10.0.0.0-::ffff:10.0.0.254"),
+			false, false,
+		},
+		{
+			mustIPSet("+::ffff:0.0.0.0-::ffff:255.255.255.255"),
+			mustIPSet("+::-::ffff:ffff"),
+			false, false,
+		},
+		{mustIPSet(), mustIPSet(), true, true},
+	}
+	for _, tt := range tests {
+		if got := tt.a.Equal(tt.b); got != tt.equal {
+			t.Errorf("(%v).Equal(%v) = %v; want %v", tt.a, tt.b, got, tt.equal)
+		}
+		if got := tt.a.EqualContent(tt.b); got != tt.equalCont {
+			t.Errorf("(%v).EqualContent(%v) = %v; want %v", tt.a, tt.b, got, tt.equalCont)
+		}
+		if got := tt.b.EqualContent(tt.a); got != tt.equalCont {
+			t.Errorf("(%v).EqualContent(%v) = %v; want %v", tt.b, tt.a, got, tt.equalCont)
+		}
+	}
+}
+
+func TestIPSetHash(t *testing.T) {
+	// The same set built in different orders and ways hashes equally.
+	a := mustIPSet("+10.0.0.0-10.0.0.255", "+fed0::-fed0::ff", "-10.0.0.5-10.0.0.5")
+	b := mustIPSet("+fed0::80-fed0::ff", "+10.0.0.6-10.0.0.255", "+fed0::-fed0::7f", "+10.0.0.0-10.0.0.4")
+	if !a.Equal(b) {
+		t.Fatalf("test sets not equal: %v, %v", a, b)
+	}
+	if a.Hash() != b.Hash() {
+		t.Errorf("Hash of equal sets differs: %x, %x", a.Hash(), b.Hash())
+	}
+
+	distinct := []*IPSet{
+		mustIPSet(),
+		a,
+		mustIPSet("+10.0.0.0-10.0.0.255"),
+		mustIPSet("+10.0.0.0-10.0.0.254"),
+		mustIPSet("+10.0.0.0-10.0.0.127", "+10.0.0.129-10.0.0.255"),
+		mustIPSet("+::ffff:10.0.0.0-::ffff:10.0.0.255"),
+		mustIPSet("+::-::ffff:ffff"),
+		mustIPSet("+0.0.0.0-255.255.255.255"),
+	}
+	seen := map[uint64]*IPSet{}
+	for _, s := range distinct {
+		h := s.Hash()
+		if o, ok := seen[h]; ok {
+			t.Errorf("Hash(%v) = Hash(%v) = %x", s, o, h)
+		}
+		seen[h] = s
+	}
+}
+
+func TestIPSetPrefixLenHistogram(t *testing.T) {
+	s := mustIPSet("+10.0.0.0-10.255.255.255", "-10.1.2.3-10.1.2.3")
+	// 10.0.0.0/8 minus 10.1.2.3/32 decomposes into exactly one prefix
+	// of each length from /9 to /32.
+	want := map[uint8]int{}
+	for _, p := range s.Prefixes() {
+		want[uint8(p.Bits())]++
+	}
+	got := s.PrefixLenHistogram()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PrefixLenHistogram() = %v; want %v", got, want)
+	}
+	explicit := map[uint8]int{
+		9: 1, 10: 1, 11: 1, 12: 1, 13: 1, 14: 1, 15: 1, 16: 1, 17: 1,
+		18: 1, 19: 1, 20: 1, 21: 1, 22: 1, 23: 1, 24: 1, 25: 1, 26: 1,
+		27: 1, 28: 1, 29: 1, 30: 1, 31: 1, 32: 1,
+	}
+	if !reflect.DeepEqual(got, explicit) {
+		t.Errorf("PrefixLenHistogram() = %v; want %v", got, explicit)
+	}
+
+	if got := mustIPSet().PrefixLenHistogram(); len(got) != 0 {
+		t.Errorf("empty set PrefixLenHistogram() = %v; want empty", got)
+	}
+	got = mustIPSet("+10.0.0.0-10.0.0.255", "+10.0.2.0-10.0.2.255", "+fed0::-fed0::ff").PrefixLenHistogram()
+	if want := map[uint8]int{24: 2, 120: 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PrefixLenHistogram() = %v; want %v", got, want)
+	}
+}
+
+func TestIPSetSingleFamily(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       *IPSet
+		wantErr bool
+	}{
+		{"v4", mustIPSet("+10.0.0.0-10.0.0.255", "+192.168.0.0-192.168.255.255"), false},
+		{"v6", mustIPSet("+::1-::2", "+fed0::400-fed0::4ff"), false},
+		{"4in6", mustIPSet("+::ffff:1.2.3.4-::ffff:1.2.3.4", "+::1-::1"), false},
+		{"empty", mustIPSet(), false},
+		{"mixed", mustIPSet("+10.0.0.0-10.0.0.255", "+::1-::2"), true},
+		{"mixed_4in6", mustIPSet("+1.2.3.4-1.2.3.4", "+::ffff:1.2.3.4-::ffff:1.2.3.4"), true},
+	}
+	for _, tt := range tests {
+		got, err := tt.s.SingleFamily()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: SingleFamily() error = %v; want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !got.Equal(tt.s) {
+			t.Errorf("%s: SingleFamily() = %v; want %v", tt.name, got, tt.s)
+		}
+	}
+}
+
+func TestIPSetV4Ranges(t *testing.T) {
+	got, ok := mustIPSet("+10.0.0.0-10.0.0.255", "+192.168.1.1-192.168.1.1", "+255.255.255.255-255.255.255.255").V4Ranges()
+	want := [][2]uint32{
+		{0x0a000000, 0x0a0000ff},
+		{0xc0a80101, 0xc0a80101},
+		{0xffffffff, 0xffffffff},
+	}
+	if !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("V4Ranges() = %v, %v; want %v, true", got, ok, want)
+	}
+
+	if got, ok := mustIPSet().V4Ranges(); !ok || len(got) != 0 {
+		t.Errorf("empty V4Ranges() = %v, %v; want empty, true", got, ok)
+	}
+	for _, s := range []*IPSet{
+		mustIPSet("+10.0.0.0-10.0.0.255", "+::1-::2"),
+		mustIPSet("+::ffff:10.0.0.0-::ffff:10.0.0.255"),
+	} {
+		if got, ok := s.V4Ranges(); ok || got != nil {
+			t.Errorf("(%v).V4Ranges() = %v, %v; want nil, false", s, got, ok)
+		}
+	}
+}
+
+func TestBuildFromRules(t *testing.T) {
+	allow := func(p string) Rule { return Rule{Allow: true, Prefix: mustIPPrefix(p)} }
+	deny := func(p string) Rule { return Rule{Allow: false, Prefix: mustIPPrefix(p)} }
+	tests := []struct {
+		name  string
+		rules []Rule
+		want  *IPSet
+	}{
+		{"none", nil, mustIPSet()},
+		{
+			"deny_carves_allow",
+			[]Rule{allow("10.0.0.0/8"), deny("10.1.0.0/16")},
+			mustIPSet("+10.0.0.0-10.0.255.255", "+10.2.0.0-10.255.255.255"),
+		},
+		{
+			"allow_readds_part",
+			[]Rule{allow("10.0.0.0/8"), deny("10.1.0.0/16"), allow("10.1.2.0/24")},
+			mustIPSet("+10.0.0.0-10.0.255.255", "+10.1.2.0-10.1.2.255", "+10.2.0.0-10.255.255.255"),
+		},
+		{
+			"deny_first_is_noop",
+			[]Rule{deny("10.1.0.0/16"), allow("10.1.2.0/24")},
+			mustIPSet("+10.1.2.0-10.1.2.255"),
+		},
+		{
+			"order_matters",
+			[]Rule{allow("10.1.2.0/24"), deny("10.1.0.0/16"), allow("fed0::/120")},
+			mustIPSet("+fed0::-fed0::ff"),
+		},
+	}
+	for _, tt := range tests {
+		got, err := BuildFromRules(tt.rules)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: BuildFromRules = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	got, err := BuildFromRules([]Rule{allow("10.0.0.0/8"), {Allow: false}})
+	if err == nil {
+		t.Error("BuildFromRules with invalid prefix succeeded; want error")
+	}
+	if want := mustIPSet("+10.0.0.0-10.255.255.255"); !got.Equal(want) {
+		t.Errorf("BuildFromRules with invalid prefix = %v; want %v", got, want)
+	}
+}
+
+func TestIPSetNumRanges(t *testing.T) {
+	for _, s := range []*IPSet{
+		mustIPSet(),
+		mustIPSet("+10.0.0.0-10.0.0.255"),
+		mustIPSet("+10.0.0.0-10.0.0.255", "+10.0.1.0-10.0.1.255"),
+		mustIPSet("+10.0.0.0-10.255.255.255", "-10.1.2.3-10.1.2.3", "+fed0::400-fed0::4ff"),
+	} {
+		if got, want := s.NumRanges(), len(s.Ranges()); got != want {
+			t.Errorf("(%v).NumRanges() = %d; want %d", s, got, want)
+		}
+	}
+}
+
+func TestIPSetForEachRange(t *testing.T) {
+	s := mustIPSet("+10.0.0.0-10.255.255.255", "-10.1.2.3-10.1.2.3", "+fed0::400-fed0::4ff")
+	var got []IPRange
+	s.ForEachRange(func(r IPRange) bool {
+		got = append(got, r)
+		return true
+	})
+	if want := s.Ranges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ForEachRange visited %v; want %v", got, want)
+	}
+
+	got = got[:0]
+	s.ForEachRange(func(r IPRange) bool {
+		got = append(got, r)
+		return len(got) < 2
+	})
+	if want := s.Ranges()[:2]; !reflect.DeepEqual(got, want) {
+		t.Errorf("ForEachRange stopping after 2 visited %v; want %v", got, want)
+	}
+
+	mustIPSet().ForEachRange(func(r IPRange) bool {
+		t.Errorf("ForEachRange on empty set visited %v", r)
+		return true
+	})
+
+	visit := func(r IPRange) bool {
+		sinkIPRange = r
+		return true
+	}
+	if allocs := testing.AllocsPerRun(100, func() { s.ForEachRange(visit) }); allocs != 0 {
+		t.Errorf("ForEachRange allocs = %v; want 0", allocs)
+	}
+}
+
+func TestIPSetRangesReverse(t *testing.T) {
+	for _, s := range []*IPSet{
+		mustIPSet(),
+		mustIPSet("+10.0.0.0-10.0.0.255"),
+		mustIPSet("+10.0.0.0-10.255.255.255", "-10.1.2.3-10.1.2.3", "+fed0::400-fed0::4ff"),
+	} {
+		got := s.RangesReverse()
+		fwd := s.Ranges()
+		if len(got) != len(fwd) {
+			t.Errorf("(%v).RangesReverse() = %v; want reverse of %v", s, got, fwd)
+			continue
+		}
+		for i := range got {
+			if got[i] != fwd[len(fwd)-1-i] {
+				t.Errorf("(%v).RangesReverse() = %v; want reverse of %v", s, got, fwd)
+				break
+			}
+		}
+	}
+}
+
+func TestIPSetCoalesceWithin(t *testing.T) {
+	s := mustIPSet(
+		"+10.0.0.0-10.0.0.5",
+		"+10.0.0.7-10.0.0.9",   // 1 address after the previous range
+		"+10.0.0.20-10.0.0.30", // 10 addresses after the previous range
+		"+10.0.1.0-10.0.1.0",   // 225 addresses after the previous range
+		"+255.255.255.255-255.255.255.255",
+		"+::-::1", // different family; never merged with IPv4
+		"+::4-::5",
+	)
+	tests := []struct {
+		gap  uint64
+		want []string
+	}{
+		{0, []string{"10.0.0.0-10.0.0.5", "10.0.0.7-10.0.0.9", "10.0.0.20-10.0.0.30", "10.0.1.0-10.0.1.0", "255.255.255.255-255.255.255.255", "::-::1", "::4-::5"}},
+		{1, []string{"10.0.0.0-10.0.0.9", "10.0.0.20-10.0.0.30", "10.0.1.0-10.0.1.0", "255.255.255.255-255.255.255.255", "::-::1", "::4-::5"}},
+		{2, []string{"10.0.0.0-10.0.0.9", "10.0.0.20-10.0.0.30", "10.0.1.0-10.0.1.0", "255.255.255.255-255.255.255.255", "::-::5"}},
+		{10, []string{"10.0.0.0-10.0.0.30", "10.0.1.0-10.0.1.0", "255.255.255.255-255.255.255.255", "::-::5"}},
+		{1000, []string{"10.0.0.0-10.0.1.0", "255.255.255.255-255.255.255.255", "::-::5"}},
+		{math.MaxUint64, []string{"10.0.0.0-255.255.255.255", "::-::5"}},
+	}
+	for _, tt := range tests {
+		var want []IPRange
+		for _, r := range tt.want {
+			want = append(want, MustParseIPRange(r))
+		}
+		if got := s.CoalesceWithin(tt.gap); !reflect.DeepEqual(got, want) {
+			t.Errorf("CoalesceWithin(%d) = %v; want %v", tt.gap, got, want)
+		}
+	}
+	if got := s.CoalesceWithin(0); !reflect.DeepEqual(got, s.Ranges()) {
+		t.Errorf("CoalesceWithin(0) = %v; want Ranges() = %v", got, s.Ranges())
+	}
+	if got := mustIPSet().CoalesceWithin(5); len(got) != 0 {
+		t.Errorf("empty set CoalesceWithin(5) = %v; want empty", got)
+	}
+}
+
+func TestIPSetZones(t *testing.T) {
+	zoned := mustIP("fe80::1%eth0")
+	if got := zoned.Zone(); got != "eth0" {
+		t.Fatalf("Zone() = %q; want eth0", got)
+	}
+	if got := zoned.WithZone("eth1").Zone(); got != "eth1" {
+		t.Errorf("WithZone(eth1).Zone() = %q; want eth1", got)
+	}
+
+	// Individual IP math preserves zones.
+	if got, want := AddrNext(zoned), mustIP("fe80::2%eth0"); got != want {
+		t.Errorf("AddrNext(%v) = %v; want %v", zoned, got, want)
+	}
+	if got, want := AddrAdd(zoned, 16), mustIP("fe80::11%eth0"); got != want {
+		t.Errorf("AddrAdd(%v, 16) = %v; want %v", zoned, got, want)
+	}
+
+	// Ranges and sets strip them.
+	r := IPRangeFrom(zoned, mustIP("fe80::ff%eth1"))
+	if r.From().Zone() != "" || r.To().Zone() != "" {
+		t.Errorf("IPRangeFrom kept zones: %v", r)
+	}
+	var b IPSetBuilder
+	b.Add(zoned)
+	s := buildIPSet(&b)
+	if want := mustIPSet("+fe80::1-fe80::1"); !s.Equal(want) {
+		t.Errorf("set with zoned IP = %v; want %v", s, want)
+	}
+	if !s.Contains(zoned.WithZone("")) {
+		t.Errorf("Contains(%v) = false; want true", zoned.WithZone(""))
+	}
+	if s.Contains(zoned) {
+		t.Errorf("Contains(%v) = true; want false", zoned)
+	}
+}
@@ -11,9 +11,11 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/big"
 	"net"
 	"net/netip"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -49,6 +51,22 @@ func FromStdIPRaw(std net.IP) (ip netip.Addr, ok bool) {
 	return netip.Addr{}, false
 }
 
+// ParseIPPreferV4 parses s as an IP address, like netip.ParseAddr,
+// but returns IPv4-mapped IPv6 addresses such as "::ffff:1.2.3.4" in
+// their IPv4 form, like FromStdIP does.
+//
+// netip.ParseAddr preserves the IPv6 form of such addresses. IPRange
+// and IPSet treat the two forms as different addresses, so an
+// IPv4-mapped address parsed with netip.ParseAddr is never contained
+// in a set of IPv4 addresses.
+func ParseIPPreferV4(s string) (netip.Addr, error) {
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return ip.Unmap(), nil
+}
+
 // IPNext returns the IP following ip.
 // If there is none, it returns the IP zero value.
 func AddrNext(ip netip.Addr) netip.Addr {
@@ -85,6 +103,77 @@ func AddrPrior(ip netip.Addr) netip.Addr {
 	}
 }
 
+// AddrAdd returns the IP n addresses after ip.
+// If there is none, it returns the IP zero value.
+func AddrAdd(ip netip.Addr, n uint64) netip.Addr {
+	if !ip.IsValid() {
+		return netip.Addr{}
+	}
+	a := u128From16(ip.As16())
+	if ip.Is4() {
+		v := uint64(uint32(a.lo))
+		if n > math.MaxUint32-v {
+			// Overflowed.
+			return netip.Addr{}
+		}
+		return uint128{0, v + n}.IP4()
+	}
+	addr := a.add(uint128{0, n})
+	if addr.less(a) {
+		// Overflowed.
+		return netip.Addr{}
+	}
+	return addr.IP6().WithZone(ip.Zone())
+}
+
+// AddrSub returns the IP n addresses before ip.
+// If there is none, it returns the IP zero value.
+func AddrSub(ip netip.Addr, n uint64) netip.Addr {
+	if !ip.IsValid() {
+		return netip.Addr{}
+	}
+	a := u128From16(ip.As16())
+	if ip.Is4() {
+		v := uint64(uint32(a.lo))
+		if n > v {
+			return netip.Addr{}
+		}
+		return uint128{0, v - n}.IP4()
+	}
+	if a.less(uint128{0, n}) {
+		return netip.Addr{}
+	}
+	return a.sub(uint128{0, n}).IP6().WithZone(ip.Zone())
+}
+
+// AddrBitString returns the binary representation of ip, for
+// debugging. IPv4 addresses are formatted as four dot-separated groups
+// of 8 bits, and IPv6 addresses as eight colon-separated groups of 16
+// bits. Any zone is omitted.
+//
+// If ip is the zero value, AddrBitString returns "invalid IP", like
+// netip.Addr.String.
+func AddrBitString(ip netip.Addr) string {
+	if !ip.IsValid() {
+		return "invalid IP"
+	}
+	a := ip.AsSlice()
+	group, sep := 1, byte('.')
+	if ip.Is6() {
+		group, sep = 2, ':'
+	}
+	b := make([]byte, 0, len(a)*8+len(a)/group-1)
+	for i, x := range a {
+		if i > 0 && i%group == 0 {
+			b = append(b, sep)
+		}
+		for bit := 7; bit >= 0; bit-- {
+			b = append(b, '0'+(x>>bit)&1)
+		}
+	}
+	return string(b)
+}
+
 // FromStdAddr maps the components of a standard library TCPAddr or
 // UDPAddr into an IPPort.
 func FromStdAddr(stdIP net.IP, port int, zone string) (_ netip.AddrPort, ok bool) {
@@ -150,6 +239,9 @@ func PrefixIPNet(p netip.Prefix) *net.IPNet {
 }
 
 // PrefixLastIP returns the last IP in the prefix.
+// For an IPv4 prefix shorter than /31, this is its broadcast address.
+//
+// If p is zero or otherwise invalid, PrefixLastIP returns the zero value.
 func PrefixLastIP(p netip.Prefix) netip.Addr {
 	if !p.IsValid() {
 		return netip.Addr{}
@@ -172,6 +264,94 @@ func PrefixLastIP(p netip.Prefix) netip.Addr {
 	}
 }
 
+// PrefixNumHosts returns the total number of addresses in p,
+// 2^(p.Addr().BitLen()-p.Bits()). See PrefixNumUsableHosts for the
+// number of assignable host addresses.
+//
+// If p is invalid, PrefixNumHosts returns 0.
+func PrefixNumHosts(p netip.Prefix) *big.Int {
+	if !p.IsValid() {
+		return new(big.Int)
+	}
+	return new(big.Int).Lsh(big.NewInt(1), uint(p.Addr().BitLen()-p.Bits()))
+}
+
+// PrefixNumUsableHosts returns the number of host addresses in p.
+//
+// For IPv4 prefixes shorter than /31, this excludes the network and
+// broadcast addresses. An IPv4 /31 has no such reserved addresses
+// (RFC 3021), so both of its addresses are usable, and a /32 has one.
+// IPv6 has no broadcast addresses, so for IPv6 prefixes this is the
+// same as PrefixNumHosts.
+//
+// If p is invalid, PrefixNumUsableHosts returns 0.
+func PrefixNumUsableHosts(p netip.Prefix) *big.Int {
+	n := PrefixNumHosts(p)
+	if p.IsValid() && p.Addr().Is4() && p.Bits() < 31 {
+		n.Sub(n, big.NewInt(2))
+	}
+	return n
+}
+
+// PrefixContainsRange reports whether all IPs in r are in p.
+//
+// If p or r is invalid, or they are of different address families,
+// it reports false.
+func PrefixContainsRange(p netip.Prefix, r IPRange) bool {
+	return RangeOfPrefix(p).ContainsRange(r)
+}
+
+// PrefixContainsPrefix reports whether all IPs in o are in p, that is,
+// whether o is p or one of its sub-prefixes.
+//
+// If p or o is invalid, or they are of different address families,
+// it reports false.
+func PrefixContainsPrefix(p, o netip.Prefix) bool {
+	return p.IsValid() &&
+		o.IsValid() &&
+		p.Addr().BitLen() == o.Addr().BitLen() &&
+		o.Bits() >= p.Bits() &&
+		netip.PrefixFrom(o.Addr(), p.Bits()).Masked() == p.Masked()
+}
+
+// OverlappingPrefixes returns each pair of prefixes in prefixes that
+// share any IPs, so that callers can warn about redundant entries.
+// Because two prefixes overlap only if one contains the other, the
+// containing prefix comes first in each pair. Pairs are ordered by
+// address, and invalid prefixes are ignored.
+//
+// It runs in O(n log n) time plus the size of the result.
+func OverlappingPrefixes(prefixes []netip.Prefix) [][2]netip.Prefix {
+	sorted := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		if p.IsValid() {
+			sorted = append(sorted, p)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].Masked(), sorted[j].Masked()
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c < 0
+		}
+		return a.Bits() < b.Bits()
+	})
+
+	var out [][2]netip.Prefix
+	// open holds the prefixes seen so far that contain the current
+	// one, outermost first.
+	var open []netip.Prefix
+	for _, p := range sorted {
+		for len(open) > 0 && !PrefixContainsPrefix(open[len(open)-1], p) {
+			open = open[:len(open)-1]
+		}
+		for _, o := range open {
+			out = append(out, [2]netip.Prefix{o, p})
+		}
+		open = append(open, p)
+	}
+	return out
+}
+
 // IPRange represents an inclusive range of IP addresses
 // from the same address family.
 //
@@ -242,6 +422,65 @@ func MustParseIPRange(s string) IPRange {
 	return r
 }
 
+// ParseIPRangeShorthand is like ParseIPRange, but also accepts IPv4
+// ranges whose upper bound is written as just its last octet, such as
+// "10.0.0.1-50" for 10.0.0.1 to 10.0.0.50.
+//
+// It returns an error if the range is not valid.
+func ParseIPRangeShorthand(s string) (IPRange, error) {
+	h := strings.IndexByte(s, '-')
+	if h == -1 {
+		return ParseIPRange(s)
+	}
+	from, last := s[:h], s[h+1:]
+	n, err := strconv.ParseUint(last, 10, 8)
+	if err != nil {
+		return ParseIPRange(s)
+	}
+	if len(last) > 1 && last[0] == '0' {
+		// Reject like netip.ParseAddr does, to avoid octal ambiguity.
+		return IPRange{}, fmt.Errorf("last octet %q with leading zero in range %q", last, s)
+	}
+	ip, err := netip.ParseAddr(from)
+	if err != nil {
+		return IPRange{}, fmt.Errorf("invalid From IP %q in range %q", from, s)
+	}
+	if !ip.Is4() {
+		return IPRange{}, fmt.Errorf("last-octet shorthand in non-IPv4 range %q", s)
+	}
+	a4 := ip.As4()
+	a4[3] = byte(n)
+	r := IPRangeFrom(ip, netip.AddrFrom4(a4))
+	if !r.IsValid() {
+		return IPRange{}, fmt.Errorf("range %v to %v not valid", r.from, r.to)
+	}
+	return r, nil
+}
+
+// ParseIPRangeOrPrefix parses s as either a prefix such as
+// "10.0.0.0/24" or a range of two IPs separated by a hyphen such as
+// "10.0.0.0-10.0.0.255", and returns the range of IPs it covers.
+//
+// It returns an error if s is malformed or contains both a slash and
+// a hyphen.
+func ParseIPRangeOrPrefix(s string) (IPRange, error) {
+	slash := strings.IndexByte(s, '/') != -1
+	hyphen := strings.IndexByte(s, '-') != -1
+	switch {
+	case slash && hyphen:
+		return IPRange{}, fmt.Errorf("ambiguous range or prefix %q: contains both '/' and '-'", s)
+	case slash:
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return IPRange{}, err
+		}
+		return RangeOfPrefix(p), nil
+	case hyphen:
+		return ParseIPRange(s)
+	}
+	return IPRange{}, fmt.Errorf("no '/' or '-' in range or prefix %q", s)
+}
+
 // String returns a string representation of the range.
 //
 // For a valid range, the form is "From-To" with a single hyphen
@@ -324,6 +563,11 @@ func (r IPRange) IsValid() bool {
 // Deprecated: use the correctly named and identical IsValid method instead.
 func (r IPRange) Valid() bool { return r.IsValid() }
 
+// IsSingleIP reports whether r contains exactly one IP.
+func (r IPRange) IsSingleIP() bool {
+	return r.IsValid() && r.from == r.to
+}
+
 // Contains reports whether the range r includes addr.
 //
 // An invalid range always reports false.
@@ -334,12 +578,182 @@ func (r IPRange) Contains(addr netip.Addr) bool {
 	return r.IsValid() && addr.Zone() == "" && r.contains(addr)
 }
 
+// ContainsRange reports whether all IPs in o are in r.
+//
+// If r or o is invalid, or they are of different address families,
+// it reports false.
+func (r IPRange) ContainsRange(o IPRange) bool {
+	return r.IsValid() &&
+		o.IsValid() &&
+		r.from.BitLen() == o.from.BitLen() &&
+		o.coveredBy(r)
+}
+
 // contains is like Contains, but without the validity check.
 // addr must not have a zone.
 func (r IPRange) contains(addr netip.Addr) bool {
 	return r.from.Compare(addr) <= 0 && r.to.Compare(addr) >= 0
 }
 
+// Offset returns the range from r.From()+n to r.To(),
+// the part of r remaining after skipping its first n addresses.
+//
+// If r is invalid, n is negative, or n is greater than or equal to the
+// number of addresses in r, ok is false.
+func (r IPRange) Offset(n *big.Int) (_ IPRange, ok bool) {
+	if !r.IsValid() {
+		return IPRange{}, false
+	}
+	off, ok := u128FromBig(n)
+	if !ok {
+		return IPRange{}, false
+	}
+	from := u128From16(r.from.As16())
+	if u128From16(r.to.As16()).sub(from).less(off) {
+		return IPRange{}, false
+	}
+	return IPRange{from: addrFrom128(from.add(off), r.from), to: r.to}, true
+}
+
+// Grow returns r extended by n addresses in each direction. The bounds
+// are clamped to the lowest and highest addresses of r's address
+// family.
+//
+// If r is invalid, Grow returns the zero IPRange.
+func (r IPRange) Grow(n uint64) IPRange {
+	if !r.IsValid() {
+		return IPRange{}
+	}
+	from, to := AddrSub(r.from, n), AddrAdd(r.to, n)
+	if !from.IsValid() {
+		from = RangeOfPrefix(netip.PrefixFrom(r.from, 0)).from
+	}
+	if !to.IsValid() {
+		to = RangeOfPrefix(netip.PrefixFrom(r.to, 0)).to
+	}
+	return IPRange{from: from, to: to}
+}
+
+// Shrink returns r narrowed by n addresses at each end.
+//
+// If r is invalid, or it contains 2*n or fewer addresses so nothing
+// would remain, Shrink returns the zero IPRange.
+func (r IPRange) Shrink(n uint64) IPRange {
+	if !r.IsValid() {
+		return IPRange{}
+	}
+	from, to := AddrAdd(r.from, n), AddrSub(r.to, n)
+	if !from.IsValid() || !to.IsValid() || to.Less(from) {
+		return IPRange{}
+	}
+	return IPRange{from: from, to: to}
+}
+
+// SplitAt splits r into the IPs before ip and those from ip onwards:
+// left ends at the IP before ip, and right begins at ip. If ip is
+// r.From, left is the zero IPRange.
+//
+// If ip is not in r, SplitAt returns ok=false.
+func (r IPRange) SplitAt(ip netip.Addr) (left, right IPRange, ok bool) {
+	if !r.Contains(ip) {
+		return IPRange{}, IPRange{}, false
+	}
+	if ip != r.from {
+		left = IPRange{from: r.from, to: ip.Prev()}
+	}
+	return left, IPRange{from: ip, to: r.to}, true
+}
+
+// AlignTo returns the smallest range containing r whose bounds lie on
+// boundaries of prefixes of length bits: From is rounded down to the
+// start of its /bits prefix, and To up to the end of its /bits
+// prefix.
+//
+// If bits is at least the address length of r, AlignTo returns r.
+// If r is invalid, it returns the zero IPRange.
+func (r IPRange) AlignTo(bits uint8) IPRange {
+	if !r.IsValid() {
+		return IPRange{}
+	}
+	if int(bits) >= r.from.BitLen() {
+		return r
+	}
+	from, _ := r.from.Prefix(int(bits))
+	to, _ := r.to.Prefix(int(bits))
+	return IPRange{from: from.Addr(), to: PrefixLastIP(to)}
+}
+
+// FragmentMax splits r at the boundaries of prefixes of length bits,
+// returning contiguous ranges that together cover r, in order. Each
+// range lies within a single /bits prefix, and all but the first and
+// last cover one entirely.
+//
+// It returns nil if r is invalid or bits exceeds its address length.
+func (r IPRange) FragmentMax(bits uint8) []IPRange {
+	if !r.IsValid() || int(bits) > r.from.BitLen() {
+		return nil
+	}
+	var out []IPRange
+	for from := r.from; ; {
+		p, _ := from.Prefix(int(bits))
+		to := PrefixLastIP(p)
+		if r.to.Less(to) {
+			to = r.to
+		}
+		out = append(out, IPRange{from: from, to: to})
+		if to == r.to {
+			return out
+		}
+		from = to.Next()
+	}
+}
+
+// Mid returns the address in the middle of r: for a range of n
+// addresses, the one (n-1)/2 addresses after From, rounding down. It
+// returns the zero Addr if r is invalid.
+func (r IPRange) Mid() netip.Addr {
+	if !r.IsValid() {
+		return netip.Addr{}
+	}
+	from, to := u128From16(r.from.As16()), u128From16(r.to.As16())
+	return addrFrom128(from.add(to.sub(from).halve()), r.from)
+}
+
+// size returns the number of addresses in r, which must be valid.
+func (r IPRange) size() *big.Int {
+	n := u128From16(r.to.As16()).sub(u128From16(r.from.As16())).big()
+	return n.Add(n, big.NewInt(1))
+}
+
+// addrFrom128 returns a as an address of the same family as like.
+func addrFrom128(a uint128, like netip.Addr) netip.Addr {
+	if like.Is4() {
+		return a.IP4()
+	}
+	return a.IP6()
+}
+
+// Equal reports whether r and o are the same range. As with IPSet.Equal,
+// an IPv4 range and its IPv4-mapped IPv6 equivalent are not equal; use
+// Unmap on the bounds first to treat them as the same.
+func (r IPRange) Equal(o IPRange) bool {
+	return r.from == o.from && r.to == o.to
+}
+
+// Compare returns an integer comparing two ranges.
+// The result is 0 if r == o, -1 if r < o, and +1 if r > o.
+//
+// Ranges are ordered first by From, then by To, using the order of
+// netip.Addr.Compare, in which IPv4 addresses sort before IPv6
+// addresses. The zero IPRange sorts before all others.
+// The normalized ranges of an IPSet are in ascending Compare order.
+func (r IPRange) Compare(o IPRange) int {
+	if c := r.from.Compare(o.from); c != 0 {
+		return c
+	}
+	return r.to.Compare(o.to)
+}
+
 // less reports whether r is "before" other. It is before if r.From()
 // is before other.From(). If they're equal, then the larger range
 // (higher To()) comes first.
@@ -448,6 +862,63 @@ func (r IPRange) Overlaps(o IPRange) bool {
 		o.from.Compare(r.to) <= 0
 }
 
+// Intersect returns the range of IPs that are in both r and o.
+//
+// If r and o do not overlap, including when either is invalid or they
+// are of different address families, Intersect returns the zero
+// IPRange and ok=false.
+func (r IPRange) Intersect(o IPRange) (inter IPRange, ok bool) {
+	if !r.Overlaps(o) {
+		return IPRange{}, false
+	}
+	inter = r
+	if inter.from.Less(o.from) {
+		inter.from = o.from
+	}
+	if o.to.Less(inter.to) {
+		inter.to = o.to
+	}
+	return inter, true
+}
+
+// Clamp returns the portion of r that lies within bounds.
+// It is equivalent to r.Intersect(bounds).
+func (r IPRange) Clamp(bounds IPRange) (clamped IPRange, ok bool) {
+	return r.Intersect(bounds)
+}
+
+// Adjacent reports whether r and o are next to each other without
+// overlapping, that is, whether one ends at the address immediately
+// before the other begins.
+//
+// If r and o are of different address families or either are invalid,
+// it reports false.
+func (r IPRange) Adjacent(o IPRange) bool {
+	return r.IsValid() &&
+		o.IsValid() &&
+		(r.to.Next() == o.from || o.to.Next() == r.from)
+}
+
+// Union returns the single range covering both r and o.
+//
+// If r and o neither overlap nor are adjacent, their union cannot be
+// represented as a single range, and Union returns the zero IPRange and
+// ok=false. The same holds if either is invalid or they are of
+// different address families.
+func (r IPRange) Union(o IPRange) (union IPRange, ok bool) {
+	if !r.Overlaps(o) && !r.Adjacent(o) {
+		return IPRange{}, false
+	}
+	union = r
+	if o.from.Less(union.from) {
+		union.from = o.from
+	}
+	if union.to.Less(o.to) {
+		union.to = o.to
+	}
+	return union, true
+}
+
 // prefixMaker returns a address-family-corrected IPPrefix from a and bits,
 // where the input bits is always in the IPv6-mapped form for IPv4 addresses.
 type prefixMaker func(a uint128, bits uint8) netip.Prefix
@@ -525,3 +996,26 @@ func appendRangePrefixes(dst []netip.Prefix, makePrefix prefixMaker, a, b uint12
 	dst = appendRangePrefixes(dst, makePrefix, b.bitsClearedFrom(common+1), b)
 	return dst
 }
+
+// forEachRangePrefix calls f for each prefix that appendRangePrefixes
+// would append for the range a to b, in order, stopping early if f
+// returns false. It reports whether f always returned true.
+func forEachRangePrefix(makePrefix prefixMaker, a, b uint128, f func(netip.Prefix) bool) bool {
+	common, ok := comparePrefixes(a, b)
+	if ok {
+		return f(makePrefix(a, common))
+	}
+	return forEachRangePrefix(makePrefix, a, a.bitsSetFrom(common+1), f) &&
+		forEachRangePrefix(makePrefix, b.bitsClearedFrom(common+1), b, f)
+}
+
+// countRangePrefixes returns the number of prefixes that
+// appendRangePrefixes would append for the range a to b.
+func countRangePrefixes(a, b uint128) int {
+	common, ok := comparePrefixes(a, b)
+	if ok {
+		return 1
+	}
+	return countRangePrefixes(a, a.bitsSetFrom(common+1)) +
+		countRangePrefixes(b.bitsClearedFrom(common+1), b)
+}
@@ -10,9 +10,12 @@ import (
 	"bytes"
 	"encoding"
 	"flag"
+	"math/big"
+	"math/rand"
 	"net"
 	"net/netip"
 	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -103,6 +106,43 @@ func TestFromStdIP(t *testing.T) {
 	}
 }
 
+func TestParseIPPreferV4(t *testing.T) {
+	tests := []struct {
+		in   string
+		want IP
+	}{
+		{"1.2.3.4", mustIP("1.2.3.4")},
+		{"::ffff:1.2.3.4", mustIP("1.2.3.4")},
+		{"::ffff:102:304", mustIP("1.2.3.4")},
+		{"::1.2.3.4", mustIP("::102:304")},
+		{"2001:db8::1", mustIP("2001:db8::1")},
+		{"fe80::1%eth0", mustIP("fe80::1%eth0")},
+	}
+	for _, tt := range tests {
+		got, err := ParseIPPreferV4(tt.in)
+		if err != nil {
+			t.Errorf("ParseIPPreferV4(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseIPPreferV4(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+	if _, err := ParseIPPreferV4("1.2.3"); err == nil {
+		t.Error("ParseIPPreferV4(\"1.2.3\") succeeded; want error")
+	}
+
+	var b IPSetBuilder
+	b.AddPrefix(mustIPPrefix("1.2.3.0/24"))
+	s, _ := b.IPSet()
+	if ip := mustIP("::ffff:1.2.3.4"); s.Contains(ip) {
+		t.Errorf("IPv4 set contains %v parsed by netip.ParseAddr", ip)
+	}
+	if ip, _ := ParseIPPreferV4("::ffff:1.2.3.4"); !s.Contains(ip) {
+		t.Errorf("IPv4 set does not contain %v parsed by ParseIPPreferV4", ip)
+	}
+}
+
 func TestFromStdIPNet(t *testing.T) {
 	tests := []struct {
 		name string
@@ -181,6 +221,188 @@ func TestIPPrefixIsSingleIP(t *testing.T) {
 	}
 }
 
+func TestIPRangeIsSingleIP(t *testing.T) {
+	tests := []struct {
+		r    IPRange
+		want bool
+	}{
+		{r: MustParseIPRange("127.0.0.1-127.0.0.1"), want: true},
+		{r: MustParseIPRange("127.0.0.1-127.0.0.2"), want: false},
+		{r: MustParseIPRange("::1-::1"), want: true},
+		{r: MustParseIPRange("::1-::ffff"), want: false},
+		{r: IPRange{mustIP("1.2.3.4"), mustIP("::1")}, want: false},
+		{r: IPRange{}, want: false},
+	}
+	for _, tt := range tests {
+		got := tt.r.IsSingleIP()
+		if got != tt.want {
+			t.Errorf("IsSingleIP(%v) = %v want %v", tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixLastIP(t *testing.T) {
+	tests := []struct {
+		p    IPPrefix
+		want IP
+	}{
+		{mustIPPrefix("10.1.2.0/24"), mustIP("10.1.2.255")},
+		{mustIPPrefix("10.1.2.3/24"), mustIP("10.1.2.255")},
+		{mustIPPrefix("10.1.2.3/32"), mustIP("10.1.2.3")},
+		{mustIPPrefix("0.0.0.0/0"), mustIP("255.255.255.255")},
+		{mustIPPrefix("2001:db8:1:2::/64"), mustIP("2001:db8:1:2:ffff:ffff:ffff:ffff")},
+		{mustIPPrefix("::/0"), mustIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")},
+		{IPPrefix{}, IP{}},
+	}
+	for _, tt := range tests {
+		if got := PrefixLastIP(tt.p); got != tt.want {
+			t.Errorf("PrefixLastIP(%v) = %v; want %v", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixNumHosts(t *testing.T) {
+	tests := []struct {
+		p             string
+		total, usable string
+	}{
+		{"10.0.0.0/24", "256", "254"},
+		{"10.0.0.0/30", "4", "2"},
+		{"10.0.0.0/31", "2", "2"},
+		{"10.0.0.1/32", "1", "1"},
+		{"0.0.0.0/0", "4294967296", "4294967294"},
+		{"fed0::/120", "256", "256"},
+		{"fed0::/127", "2", "2"},
+		{"fed0::1/128", "1", "1"},
+		{"::/0", "340282366920938463463374607431768211456", "340282366920938463463374607431768211456"},
+	}
+	for _, tt := range tests {
+		p := mustIPPrefix(tt.p)
+		if got := PrefixNumHosts(p).String(); got != tt.total {
+			t.Errorf("PrefixNumHosts(%v) = %v; want %v", p, got, tt.total)
+		}
+		if got := PrefixNumUsableHosts(p).String(); got != tt.usable {
+			t.Errorf("PrefixNumUsableHosts(%v) = %v; want %v", p, got, tt.usable)
+		}
+	}
+	if got := PrefixNumHosts(IPPrefix{}); got.Sign() != 0 {
+		t.Errorf("PrefixNumHosts(IPPrefix{}) = %v; want 0", got)
+	}
+	if got := PrefixNumUsableHosts(IPPrefix{}); got.Sign() != 0 {
+		t.Errorf("PrefixNumUsableHosts(IPPrefix{}) = %v; want 0", got)
+	}
+}
+
+func TestPrefixContainsRange(t *testing.T) {
+	tests := []struct {
+		p    IPPrefix
+		r    IPRange
+		want bool
+	}{
+		{mustIPPrefix("10.0.0.0/24"), MustParseIPRange("10.0.0.0-10.0.0.255"), true},   // exactly fills
+		{mustIPPrefix("10.0.0.0/24"), MustParseIPRange("10.0.0.10-10.0.0.20"), true},   // strictly inside
+		{mustIPPrefix("10.0.0.0/24"), MustParseIPRange("10.0.0.255-10.0.0.255"), true}, // last address
+		{mustIPPrefix("10.0.0.0/24"), MustParseIPRange("10.0.0.10-10.0.1.0"), false},   // one past the end
+		{mustIPPrefix("10.0.0.0/24"), MustParseIPRange("9.255.255.255-10.0.0.5"), false},
+		{mustIPPrefix("10.0.0.7/24"), MustParseIPRange("10.0.0.0-10.0.0.5"), true}, // unmasked prefix
+		{mustIPPrefix("0.0.0.0/0"), MustParseIPRange("0.0.0.0-255.255.255.255"), true},
+		{mustIPPrefix("::/0"), MustParseIPRange("0.0.0.0-255.255.255.255"), false}, // family mismatch
+		{mustIPPrefix("::/0"), MustParseIPRange("::ffff:0.0.0.0-::ffff:255.255.255.255"), true},
+		{mustIPPrefix("fed0::/64"), MustParseIPRange("fed0::1-fed0::ffff:ffff:ffff:ffff"), true},
+		{mustIPPrefix("fed0::/64"), MustParseIPRange("fed0::1-fed0:0:0:1::"), false},
+		{IPPrefix{}, MustParseIPRange("10.0.0.0-10.0.0.5"), false},
+		{mustIPPrefix("10.0.0.0/24"), IPRange{}, false},
+	}
+	for _, tt := range tests {
+		if got := PrefixContainsRange(tt.p, tt.r); got != tt.want {
+			t.Errorf("PrefixContainsRange(%v, %v) = %v; want %v", tt.p, tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixContainsPrefix(t *testing.T) {
+	tests := []struct {
+		p, o string
+		want bool
+	}{
+		{"10.0.0.0/8", "10.1.0.0/16", true},       // nested
+		{"10.0.0.0/8", "10.255.255.255/32", true}, // nested host
+		{"10.0.0.0/8", "10.0.0.0/8", true},        // equal
+		{"10.0.0.0/8", "10.1.2.3/8", true},        // equal after masking
+		{"10.1.2.3/8", "10.200.0.0/16", true},     // p unmasked
+		{"10.1.0.0/16", "10.0.0.0/8", false},      // o contains p
+		{"10.0.0.0/9", "10.128.0.0/9", false},     // siblings
+		{"10.0.0.0/8", "11.0.0.0/16", false},      // disjoint
+		{"0.0.0.0/0", "1.2.3.4/32", true},
+		{"::/0", "1.2.3.4/32", false}, // family mismatch
+		{"::/0", "::ffff:1.2.3.4/128", true},
+		{"fed0::/64", "fed0::1:0/112", true},
+		{"fed0::/64", "fed0:0:0:1::/64", false},
+	}
+	for _, tt := range tests {
+		p, o := mustIPPrefix(tt.p), mustIPPrefix(tt.o)
+		if got := PrefixContainsPrefix(p, o); got != tt.want {
+			t.Errorf("PrefixContainsPrefix(%v, %v) = %v; want %v", p, o, got, tt.want)
+		}
+	}
+	if PrefixContainsPrefix(IPPrefix{}, IPPrefix{}) {
+		t.Error("PrefixContainsPrefix of zero prefixes = true; want false")
+	}
+}
+
+func TestOverlappingPrefixes(t *testing.T) {
+	pair := func(a, b string) [2]IPPrefix {
+		return [2]IPPrefix{mustIPPrefix(a), mustIPPrefix(b)}
+	}
+	tests := []struct {
+		name string
+		in   []IPPrefix
+		want [][2]IPPrefix
+	}{
+		{
+			name: "disjoint",
+			in:   pxv("10.0.0.0/24", "10.0.1.0/24", "192.168.0.0/16", "fed0::/64"),
+		},
+		{
+			name: "nested",
+			in:   pxv("10.0.1.0/24", "10.0.0.0/8", "10.0.1.128/25", "10.2.0.0/16"),
+			want: [][2]IPPrefix{
+				pair("10.0.0.0/8", "10.0.1.0/24"),
+				pair("10.0.0.0/8", "10.0.1.128/25"),
+				pair("10.0.1.0/24", "10.0.1.128/25"),
+				pair("10.0.0.0/8", "10.2.0.0/16"),
+			},
+		},
+		{
+			name: "identical",
+			in:   pxv("10.0.0.0/24", "192.168.0.0/24", "10.0.0.0/24"),
+			want: [][2]IPPrefix{pair("10.0.0.0/24", "10.0.0.0/24")},
+		},
+		{
+			name: "unmasked",
+			in:   pxv("10.0.0.0/24", "10.0.0.5/24"),
+			want: [][2]IPPrefix{pair("10.0.0.0/24", "10.0.0.5/24")},
+		},
+		{
+			name: "families",
+			in:   pxv("0.0.0.0/0", "::/0", "::ffff:10.0.0.0/104", "10.0.0.0/8"),
+			want: [][2]IPPrefix{
+				pair("0.0.0.0/0", "10.0.0.0/8"),
+				pair("::/0", "::ffff:10.0.0.0/104"),
+			},
+		},
+		{
+			name: "invalid",
+			in:   []IPPrefix{{}, mustIPPrefix("10.0.0.0/8"), {}},
+		},
+	}
+	for _, tt := range tests {
+		if got := OverlappingPrefixes(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: OverlappingPrefixes(%v) = %v; want %v", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
 type appendMarshaler interface {
 	encoding.TextMarshaler
 	AppendTo([]byte) []byte
@@ -466,6 +688,82 @@ func TestParseIPRange(t *testing.T) {
 	}
 }
 
+func TestParseIPRangeShorthand(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{"10.0.0.1-50", MustParseIPRange("10.0.0.1-10.0.0.50")},
+		{"10.0.0.0-255", MustParseIPRange("10.0.0.0-10.0.0.255")},
+		{"10.0.0.7-7", MustParseIPRange("10.0.0.7-10.0.0.7")},
+		{"10.0.0.0-0", MustParseIPRange("10.0.0.0-10.0.0.0")},
+		{"10.0.0.1-10.0.1.50", MustParseIPRange("10.0.0.1-10.0.1.50")},
+		{"fed0::1-fed0::50", MustParseIPRange("fed0::1-fed0::50")},
+		{"10.0.0.50-1", "range 10.0.0.50 to 10.0.0.1 not valid"},
+		{"10.0.0.1-256", `invalid To IP "256" in range "10.0.0.1-256"`},
+		{"10.0.0.1-050", `last octet "050" with leading zero in range "10.0.0.1-050"`},
+		{"10.0.0.1-00", `last octet "00" with leading zero in range "10.0.0.1-00"`},
+		{"10.0.0.1-", `invalid To IP "" in range "10.0.0.1-"`},
+		{"foo-50", `invalid From IP "foo" in range "foo-50"`},
+		{"fed0::1-50", `last-octet shorthand in non-IPv4 range "fed0::1-50"`},
+		{"10.0.0.1", `no hyphen in range "10.0.0.1"`},
+	}
+	for _, tt := range tests {
+		r, err := ParseIPRangeShorthand(tt.in)
+		var got interface{}
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = r
+		}
+		if got != tt.want {
+			t.Errorf("ParseIPRangeShorthand(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+
+	// ParseIPRange itself stays strict.
+	if r, err := ParseIPRange("10.0.0.1-50"); err == nil {
+		t.Errorf("ParseIPRange(%q) = %v; want error", "10.0.0.1-50", r)
+	}
+}
+
+func TestParseIPRangeOrPrefix(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{"10.0.0.0/24", MustParseIPRange("10.0.0.0-10.0.0.255")},
+		{"10.0.0.5/24", MustParseIPRange("10.0.0.0-10.0.0.255")},
+		{"10.0.0.0-10.0.0.255", MustParseIPRange("10.0.0.0-10.0.0.255")},
+		{"10.0.0.7-10.0.0.9", MustParseIPRange("10.0.0.7-10.0.0.9")},
+		{"fed0::/120", MustParseIPRange("fed0::-fed0::ff")},
+		{"fed0::1-fed0::5", MustParseIPRange("fed0::1-fed0::5")},
+		{"", `no '/' or '-' in range or prefix ""`},
+		{"10.0.0.1", `no '/' or '-' in range or prefix "10.0.0.1"`},
+		{"10.0.0.0/24-10.0.1.0/24", `ambiguous range or prefix "10.0.0.0/24-10.0.1.0/24": contains both '/' and '-'`},
+		{"10.0.0.0-10.0.0.255/24", `ambiguous range or prefix "10.0.0.0-10.0.0.255/24": contains both '/' and '-'`},
+		{"10.0.0.9-10.0.0.1", "range 10.0.0.9 to 10.0.0.1 not valid"},
+		{"1.2.3.4-foo", `invalid To IP "foo" in range "1.2.3.4-foo"`},
+	}
+	for _, tt := range tests {
+		r, err := ParseIPRangeOrPrefix(tt.in)
+		var got interface{}
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = r
+		}
+		if got != tt.want {
+			t.Errorf("ParseIPRangeOrPrefix(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"10.0.0.0/33", "foo/8"} {
+		if r, err := ParseIPRangeOrPrefix(bad); err == nil {
+			t.Errorf("ParseIPRangeOrPrefix(%q) = %v; want error", bad, r)
+		}
+	}
+}
+
 func TestIPRangeUnmarshalTextNonZero(t *testing.T) {
 	r := MustParseIPRange("1.2.3.4-5.6.7.8")
 	if err := r.UnmarshalText([]byte("1.2.3.4-5.6.7.8")); err == nil {
@@ -529,6 +827,34 @@ func TestIPRangeContains(t *testing.T) {
 	}
 }
 
+func TestIPRangeContainsRange(t *testing.T) {
+	r := MustParseIPRange("10.0.0.10-10.0.0.20")
+	tests := []struct {
+		r, o IPRange
+		want bool
+	}{
+		{r, MustParseIPRange("10.0.0.12-10.0.0.18"), true}, // nested
+		{r, MustParseIPRange("10.0.0.10-10.0.0.10"), true}, // first address
+		{r, MustParseIPRange("10.0.0.20-10.0.0.20"), true}, // last address
+		{r, r, true}, // equal
+		{r, MustParseIPRange("10.0.0.5-10.0.0.15"), false},  // overlaps start
+		{r, MustParseIPRange("10.0.0.15-10.0.0.25"), false}, // overlaps end
+		{r, MustParseIPRange("10.0.0.0-10.0.0.255"), false}, // contains r
+		{r, MustParseIPRange("10.0.0.21-10.0.0.30"), false}, // disjoint
+		{r, MustParseIPRange("::ffff:10.0.0.12-::ffff:10.0.0.18"), false},
+		{MustParseIPRange("::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), MustParseIPRange("::1-::2"), true},
+		{MustParseIPRange("::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), MustParseIPRange("1.2.3.4-1.2.3.4"), false},
+		{r, IPRange{}, false},
+		{IPRange{}, r, false},
+		{r, IPRange{mustIP("10.0.0.18"), mustIP("10.0.0.12")}, false}, // invalid o
+	}
+	for _, tt := range tests {
+		if got := tt.r.ContainsRange(tt.o); got != tt.want {
+			t.Errorf("(%v).ContainsRange(%v) = %v; want %v", tt.r, tt.o, got, tt.want)
+		}
+	}
+}
+
 func TestIPRangeOverlaps(t *testing.T) {
 	tests := []struct {
 		r, o IPRange
@@ -582,6 +908,428 @@ func TestIPRangeOverlaps(t *testing.T) {
 	}
 }
 
+func TestIPRangeIntersect(t *testing.T) {
+	tests := []struct {
+		r, o   IPRange
+		want   IPRange
+		wantOK bool
+	}{
+		{MustParseIPRange("10.0.0.5-10.0.0.15"), MustParseIPRange("10.0.0.10-10.0.0.20"), MustParseIPRange("10.0.0.10-10.0.0.15"), true},  // r overlaps start of o
+		{MustParseIPRange("10.0.0.15-10.0.0.25"), MustParseIPRange("10.0.0.10-10.0.0.20"), MustParseIPRange("10.0.0.15-10.0.0.20"), true}, // r overlaps end of o
+		{MustParseIPRange("10.0.0.12-10.0.0.18"), MustParseIPRange("10.0.0.10-10.0.0.20"), MustParseIPRange("10.0.0.12-10.0.0.18"), true}, // o contains r
+		{MustParseIPRange("10.0.0.10-10.0.0.20"), MustParseIPRange("10.0.0.12-10.0.0.18"), MustParseIPRange("10.0.0.12-10.0.0.18"), true}, // r contains o
+		{MustParseIPRange("fed0::1-fed0::ff"), MustParseIPRange("fed0::80-fed0::1:0"), MustParseIPRange("fed0::80-fed0::ff"), true},
+		{MustParseIPRange("10.0.0.0-10.0.0.9"), MustParseIPRange("10.0.0.10-10.0.0.20"), IPRange{}, false}, // disjoint
+		{MustParseIPRange("10.0.0.21-10.0.0.30"), MustParseIPRange("10.0.0.10-10.0.0.20"), IPRange{}, false},
+		{MustParseIPRange("0.0.0.0-255.255.255.255"), MustParseIPRange("::-::ffff"), IPRange{}, false}, // family mismatch
+		{IPRange{}, MustParseIPRange("10.0.0.10-10.0.0.20"), IPRange{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.r.Intersect(tt.o)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("(%v).Intersect(%v) = %v, %v; want %v, %v", tt.r, tt.o, got, ok, tt.want, tt.wantOK)
+		}
+		got, ok = tt.o.Intersect(tt.r)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("(%v).Intersect(%v) = %v, %v; want %v, %v", tt.o, tt.r, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestIPRangeClamp(t *testing.T) {
+	bounds := MustParseIPRange("10.0.0.10-10.0.0.20")
+	tests := []struct {
+		r      IPRange
+		want   IPRange
+		wantOK bool
+	}{
+		{MustParseIPRange("10.0.0.5-10.0.0.15"), MustParseIPRange("10.0.0.10-10.0.0.15"), true},  // overlaps start
+		{MustParseIPRange("10.0.0.15-10.0.0.25"), MustParseIPRange("10.0.0.15-10.0.0.20"), true}, // overlaps end
+		{MustParseIPRange("10.0.0.12-10.0.0.18"), MustParseIPRange("10.0.0.12-10.0.0.18"), true}, // inside bounds
+		{MustParseIPRange("10.0.0.0-10.0.0.255"), bounds, true},                                  // covers bounds
+		{MustParseIPRange("10.0.0.20-10.0.0.30"), MustParseIPRange("10.0.0.20-10.0.0.20"), true}, // touches edge
+		{MustParseIPRange("10.0.0.0-10.0.0.9"), IPRange{}, false},                                // before
+		{MustParseIPRange("10.0.0.21-10.0.0.30"), IPRange{}, false},                              // after
+		{MustParseIPRange("::1-::ffff"), IPRange{}, false},                                       // family mismatch
+		{IPRange{}, IPRange{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.r.Clamp(bounds)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("(%v).Clamp(%v) = %v, %v; want %v, %v", tt.r, bounds, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestIPRangeAdjacent(t *testing.T) {
+	tests := []struct {
+		r, o IPRange
+		want bool
+	}{
+		{MustParseIPRange("10.0.0.0-10.0.0.10"), MustParseIPRange("10.0.0.11-10.0.0.20"), true},
+		{MustParseIPRange("10.0.0.0-10.0.0.255"), MustParseIPRange("10.0.1.0-10.0.1.255"), true},       // carry into third byte
+		{MustParseIPRange("9.255.255.255-9.255.255.255"), MustParseIPRange("10.0.0.0-10.0.0.0"), true}, // carry across all bytes
+		{MustParseIPRange("::-::ffff:ffff:ffff:ffff"), MustParseIPRange("0:0:0:1::-::1:0:0:0:0"), true},
+		{MustParseIPRange("10.0.0.0-10.0.0.10"), MustParseIPRange("10.0.0.10-10.0.0.20"), false}, // overlap on edge
+		{MustParseIPRange("10.0.0.0-10.0.0.10"), MustParseIPRange("10.0.0.5-10.0.0.20"), false},  // overlap
+		{MustParseIPRange("10.0.0.0-10.0.0.10"), MustParseIPRange("10.0.0.12-10.0.0.20"), false}, // gap
+		{MustParseIPRange("0.0.0.0-255.255.255.255"), MustParseIPRange("::-::"), false},          // family mismatch
+		{MustParseIPRange("10.0.0.0-10.0.0.10"), IPRange{}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.r.Adjacent(tt.o); got != tt.want {
+			t.Errorf("(%v).Adjacent(%v) = %v; want %v", tt.r, tt.o, got, tt.want)
+		}
+		if got := tt.o.Adjacent(tt.r); got != tt.want {
+			t.Errorf("(%v).Adjacent(%v) (reversed) = %v; want %v", tt.o, tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestIPRangeUnion(t *testing.T) {
+	tests := []struct {
+		r, o   IPRange
+		want   IPRange
+		wantOK bool
+	}{
+		{
+			MustParseIPRange("10.0.0.0-10.0.0.10"),
+			MustParseIPRange("10.0.0.5-10.0.0.20"),
+			MustParseIPRange("10.0.0.0-10.0.0.20"),
+			true, // overlapping
+		},
+		{
+			MustParseIPRange("10.0.0.0-10.0.0.20"),
+			MustParseIPRange("10.0.0.5-10.0.0.10"),
+			MustParseIPRange("10.0.0.0-10.0.0.20"),
+			true, // one inside the other
+		},
+		{
+			MustParseIPRange("10.0.0.0-10.0.0.255"),
+			MustParseIPRange("10.0.1.0-10.0.1.255"),
+			MustParseIPRange("10.0.0.0-10.0.1.255"),
+			true, // adjacent
+		},
+		{
+			MustParseIPRange("::1-::ffff"),
+			MustParseIPRange("::1:0-::1:ffff"),
+			MustParseIPRange("::1-::1:ffff"),
+			true, // adjacent IPv6
+		},
+		{
+			MustParseIPRange("10.0.0.0-10.0.0.10"),
+			MustParseIPRange("10.0.0.12-10.0.0.20"),
+			IPRange{},
+			false, // gap of one address
+		},
+		{
+			MustParseIPRange("0.0.0.0-255.255.255.255"),
+			MustParseIPRange("::-::ffff"),
+			IPRange{},
+			false, // family mismatch
+		},
+		{
+			MustParseIPRange("10.0.0.0-10.0.0.10"),
+			IPRange{},
+			IPRange{},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		got, ok := tt.r.Union(tt.o)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("(%v).Union(%v) = %v, %v; want %v, %v", tt.r, tt.o, got, ok, tt.want, tt.wantOK)
+		}
+		got, ok = tt.o.Union(tt.r)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("(%v).Union(%v) (reversed) = %v, %v; want %v, %v", tt.o, tt.r, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestIPRangeCompare(t *testing.T) {
+	// Ranges in ascending order.
+	values := []IPRange{
+		{},
+		MustParseIPRange("0.0.0.0-0.0.0.0"),
+		MustParseIPRange("1.2.3.4-1.2.3.4"),
+		MustParseIPRange("1.2.3.4-1.2.3.5"),
+		MustParseIPRange("1.2.3.4-255.255.255.255"),
+		MustParseIPRange("1.2.3.5-1.2.3.5"),
+		MustParseIPRange("::-::"),
+		MustParseIPRange("::-::1"),
+		MustParseIPRange("::ffff:1.2.3.4-::ffff:1.2.3.4"),
+		MustParseIPRange("fed0::400-fed0::4ff"),
+	}
+	for i, a := range values {
+		for j, b := range values {
+			want := 0
+			switch {
+			case i < j:
+				want = -1
+			case i > j:
+				want = 1
+			}
+			if got := a.Compare(b); got != want {
+				t.Errorf("(%v).Compare(%v) = %d; want %d", a, b, got, want)
+			}
+		}
+	}
+
+	s := mustIPSet(
+		"+fed0::400-fed0::4ff",
+		"+10.0.0.0-10.255.255.255",
+		"-10.1.2.3-10.1.2.3",
+		"+::ffff:1.2.3.4-::ffff:1.2.3.4",
+	)
+	rr := s.Ranges()
+	shuffled := append([]IPRange(nil), rr...)
+	rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	sort.Slice(shuffled, func(i, j int) bool { return shuffled[i].Compare(shuffled[j]) < 0 })
+	if !reflect.DeepEqual(shuffled, rr) {
+		t.Errorf("sorted by Compare = %v; want IPSet order %v", shuffled, rr)
+	}
+}
+
+func TestIPRangeOffset(t *testing.T) {
+	r := MustParseIPRange("10.0.0.0-10.0.0.255")
+	tests := []struct {
+		r      IPRange
+		n      int64
+		want   IPRange
+		wantOK bool
+	}{
+		{r, 0, r, true},
+		{r, 1, MustParseIPRange("10.0.0.1-10.0.0.255"), true},
+		{r, 100, MustParseIPRange("10.0.0.100-10.0.0.255"), true},
+		{r, 255, MustParseIPRange("10.0.0.255-10.0.0.255"), true},
+		{r, 256, IPRange{}, false},
+		{r, 1 << 40, IPRange{}, false},
+		{r, -1, IPRange{}, false},
+		{MustParseIPRange("10.0.0.255-10.0.1.10"), 2, MustParseIPRange("10.0.1.1-10.0.1.10"), true},
+		{MustParseIPRange("::-::1:0"), 1 << 16, MustParseIPRange("::1:0-::1:0"), true},
+		{IPRange{}, 0, IPRange{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.r.Offset(big.NewInt(tt.n))
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("(%v).Offset(%d) = %v, %v; want %v, %v", tt.r, tt.n, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	all6 := MustParseIPRange("::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")
+	n := new(big.Int).Lsh(big.NewInt(1), 127)
+	if got, ok := all6.Offset(n); !ok || got != MustParseIPRange("8000::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff") {
+		t.Errorf("(%v).Offset(2^127) = %v, %v", all6, got, ok)
+	}
+	n.Lsh(n, 1)
+	if got, ok := all6.Offset(n); ok {
+		t.Errorf("(%v).Offset(2^128) = %v, %v; want not ok", all6, got, ok)
+	}
+}
+
+func TestIPRangeGrowShrink(t *testing.T) {
+	tests := []struct {
+		r      IPRange
+		n      uint64
+		grow   IPRange
+		shrink IPRange
+	}{
+		{
+			MustParseIPRange("10.0.0.10-10.0.0.20"), 0,
+			MustParseIPRange("10.0.0.10-10.0.0.20"),
+			MustParseIPRange("10.0.0.10-10.0.0.20"),
+		},
+		{
+			MustParseIPRange("10.0.0.10-10.0.0.20"), 5,
+			MustParseIPRange("10.0.0.5-10.0.0.25"),
+			MustParseIPRange("10.0.0.15-10.0.0.15"),
+		},
+		{
+			MustParseIPRange("10.0.0.10-10.0.0.20"), 6,
+			MustParseIPRange("10.0.0.4-10.0.0.26"),
+			IPRange{}, // shrinks to empty
+		},
+		{
+			MustParseIPRange("10.0.0.10-10.0.0.20"), 256,
+			MustParseIPRange("9.255.255.10-10.0.1.20"),
+			IPRange{},
+		},
+		{
+			MustParseIPRange("0.0.0.3-0.0.0.10"), 5,
+			MustParseIPRange("0.0.0.0-0.0.0.15"), // clamped at 0.0.0.0
+			IPRange{},
+		},
+		{
+			MustParseIPRange("255.255.255.0-255.255.255.250"), 10,
+			MustParseIPRange("255.255.254.246-255.255.255.255"), // clamped at the top
+			MustParseIPRange("255.255.255.10-255.255.255.240"),
+		},
+		{
+			MustParseIPRange("0.0.0.0-255.255.255.255"), 1 << 40,
+			MustParseIPRange("0.0.0.0-255.255.255.255"),
+			IPRange{},
+		},
+		{
+			MustParseIPRange("::5-fed0::"), 10,
+			MustParseIPRange("::-fed0::a"),
+			MustParseIPRange("::f-fecf:ffff:ffff:ffff:ffff:ffff:ffff:fff6"),
+		},
+		{IPRange{}, 1, IPRange{}, IPRange{}},
+	}
+	for _, tt := range tests {
+		if got := tt.r.Grow(tt.n); got != tt.grow {
+			t.Errorf("(%v).Grow(%d) = %v; want %v", tt.r, tt.n, got, tt.grow)
+		}
+		if got := tt.r.Shrink(tt.n); got != tt.shrink {
+			t.Errorf("(%v).Shrink(%d) = %v; want %v", tt.r, tt.n, got, tt.shrink)
+		}
+	}
+}
+
+func TestIPRangeSplitAt(t *testing.T) {
+	r := MustParseIPRange("10.0.0.10-10.0.0.20")
+	tests := []struct {
+		r           IPRange
+		ip          IP
+		left, right IPRange
+		ok          bool
+	}{
+		{r, mustIP("10.0.0.10"), IPRange{}, r, true}, // start
+		{r, mustIP("10.0.0.15"), MustParseIPRange("10.0.0.10-10.0.0.14"), MustParseIPRange("10.0.0.15-10.0.0.20"), true},
+		{r, mustIP("10.0.0.20"), MustParseIPRange("10.0.0.10-10.0.0.19"), MustParseIPRange("10.0.0.20-10.0.0.20"), true}, // end
+		{r, mustIP("10.0.0.9"), IPRange{}, IPRange{}, false},
+		{r, mustIP("10.0.0.21"), IPRange{}, IPRange{}, false},
+		{r, mustIP("::ffff:10.0.0.15"), IPRange{}, IPRange{}, false},
+		{r, IP{}, IPRange{}, IPRange{}, false},
+		{
+			MustParseIPRange("fed0::ffff:ffff:ffff:fff0-fed0:0:0:1::10"), mustIP("fed0:0:0:1::"),
+			MustParseIPRange("fed0::ffff:ffff:ffff:fff0-fed0::ffff:ffff:ffff:ffff"), MustParseIPRange("fed0:0:0:1::-fed0:0:0:1::10"), true,
+		},
+		{MustParseIPRange("fed0::1-fed0::5"), mustIP("fed0::3%eth0"), IPRange{}, IPRange{}, false},
+	}
+	for _, tt := range tests {
+		left, right, ok := tt.r.SplitAt(tt.ip)
+		if left != tt.left || right != tt.right || ok != tt.ok {
+			t.Errorf("(%v).SplitAt(%v) = %v, %v, %v; want %v, %v, %v", tt.r, tt.ip, left, right, ok, tt.left, tt.right, tt.ok)
+		}
+	}
+}
+
+func TestIPRangeFragmentMax(t *testing.T) {
+	rr := func(ranges ...string) (out []IPRange) {
+		for _, r := range ranges {
+			out = append(out, MustParseIPRange(r))
+		}
+		return out
+	}
+	tests := []struct {
+		r    IPRange
+		bits uint8
+		want []IPRange
+	}{
+		{
+			MustParseIPRange("10.0.0.7-10.0.3.9"), 24,
+			rr("10.0.0.7-10.0.0.255", "10.0.1.0-10.0.1.255", "10.0.2.0-10.0.2.255", "10.0.3.0-10.0.3.9"),
+		},
+		{
+			MustParseIPRange("10.0.0.0-10.0.3.255"), 24,
+			rr("10.0.0.0-10.0.0.255", "10.0.1.0-10.0.1.255", "10.0.2.0-10.0.2.255", "10.0.3.0-10.0.3.255"),
+		},
+		{MustParseIPRange("10.0.0.0-10.0.3.255"), 22, rr("10.0.0.0-10.0.3.255")},
+		{MustParseIPRange("10.0.0.0-10.0.3.255"), 8, rr("10.0.0.0-10.0.3.255")},
+		{MustParseIPRange("10.0.1.5-10.0.1.9"), 24, rr("10.0.1.5-10.0.1.9")},
+		{MustParseIPRange("10.0.1.5-10.0.1.7"), 32, rr("10.0.1.5-10.0.1.5", "10.0.1.6-10.0.1.6", "10.0.1.7-10.0.1.7")},
+		{
+			MustParseIPRange("255.255.254.128-255.255.255.255"), 24,
+			rr("255.255.254.128-255.255.254.255", "255.255.255.0-255.255.255.255"),
+		},
+		{MustParseIPRange("fed0::80-fed0::1ff"), 120, rr("fed0::80-fed0::ff", "fed0::100-fed0::1ff")},
+		{MustParseIPRange("10.0.0.0-10.0.0.255"), 33, nil},
+		{IPRange{}, 24, nil},
+	}
+	for _, tt := range tests {
+		if got := tt.r.FragmentMax(tt.bits); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("(%v).FragmentMax(%d) = %v; want %v", tt.r, tt.bits, got, tt.want)
+		}
+	}
+}
+
+func TestIPRangeEqual(t *testing.T) {
+	tests := []struct {
+		r, o IPRange
+		want bool
+	}{
+		{MustParseIPRange("10.0.0.0-10.0.0.255"), MustParseIPRange("10.0.0.0-10.0.0.255"), true},
+		{MustParseIPRange("10.0.0.0-10.0.0.255"), MustParseIPRange("10.0.0.0-10.0.0.254"), false},
+		{MustParseIPRange("10.0.0.0-10.0.0.255"), MustParseIPRange("10.0.0.1-10.0.0.255"), false},
+		{MustParseIPRange("fed0::1-fed0::5"), IPRangeFrom(mustIP("fed0::1%eth0"), mustIP("fed0::5")), true}, // zones stripped
+		{MustParseIPRange("10.0.0.0-10.0.0.255"), MustParseIPRange("::ffff:10.0.0.0-::ffff:10.0.0.255"), false},
+		{
+			IPRangeFrom(mustIP("::ffff:10.0.0.0").Unmap(), mustIP("::ffff:10.0.0.255").Unmap()),
+			MustParseIPRange("10.0.0.0-10.0.0.255"),
+			true,
+		},
+		{IPRange{}, IPRange{}, true},
+		{IPRange{}, MustParseIPRange("10.0.0.0-10.0.0.255"), false},
+	}
+	for _, tt := range tests {
+		if got := tt.r.Equal(tt.o); got != tt.want {
+			t.Errorf("(%v).Equal(%v) = %v; want %v", tt.r, tt.o, got, tt.want)
+		}
+		if got := tt.o.Equal(tt.r); got != tt.want {
+			t.Errorf("(%v).Equal(%v) = %v; want %v", tt.o, tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestIPRangeMid(t *testing.T) {
+	tests := []struct {
+		r    IPRange
+		want IP
+	}{
+		{MustParseIPRange("10.0.0.0-10.0.0.9"), mustIP("10.0.0.4")},  // even size
+		{MustParseIPRange("10.0.0.0-10.0.0.10"), mustIP("10.0.0.5")}, // odd size
+		{MustParseIPRange("10.0.0.7-10.0.0.7"), mustIP("10.0.0.7")},  // single address
+		{MustParseIPRange("10.0.0.7-10.0.0.8"), mustIP("10.0.0.7")},
+		{MustParseIPRange("0.0.0.0-255.255.255.255"), mustIP("127.255.255.255")},
+		{MustParseIPRange("::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), mustIP("7fff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")},
+		{MustParseIPRange("fed0::ffff:ffff:ffff:ffff-fed0:0:0:1::1"), mustIP("fed0:0:0:1::")}, // carry into high 64 bits
+		{MustParseIPRange("fed0::fffe-fed0::1:2"), mustIP("fed0::1:0")},
+		{IPRange{}, IP{}},
+	}
+	for _, tt := range tests {
+		if got := tt.r.Mid(); got != tt.want {
+			t.Errorf("(%v).Mid() = %v; want %v", tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestIPRangeAlignTo(t *testing.T) {
+	tests := []struct {
+		r    IPRange
+		bits uint8
+		want IPRange
+	}{
+		{MustParseIPRange("10.0.1.7-10.0.3.9"), 24, MustParseIPRange("10.0.1.0-10.0.3.255")},
+		{MustParseIPRange("10.0.1.0-10.0.3.255"), 24, MustParseIPRange("10.0.1.0-10.0.3.255")}, // already aligned
+		{MustParseIPRange("10.0.1.7-10.0.1.9"), 24, MustParseIPRange("10.0.1.0-10.0.1.255")},
+		{MustParseIPRange("10.0.1.7-10.0.3.9"), 16, MustParseIPRange("10.0.0.0-10.0.255.255")},
+		{MustParseIPRange("10.0.1.7-10.0.3.9"), 0, MustParseIPRange("0.0.0.0-255.255.255.255")},
+		{MustParseIPRange("10.0.1.7-10.0.3.9"), 32, MustParseIPRange("10.0.1.7-10.0.3.9")},
+		{MustParseIPRange("10.0.1.7-10.0.3.9"), 64, MustParseIPRange("10.0.1.7-10.0.3.9")},
+		{MustParseIPRange("fed0:1::7-fed0:3::9"), 24, MustParseIPRange("fed0::-fed0:ff:ffff:ffff:ffff:ffff:ffff:ffff")},
+		{MustParseIPRange("fed0::1:7-fed0::3:9"), 120, MustParseIPRange("fed0::1:0-fed0::3:ff")},
+		{MustParseIPRange("fed0::1:7-fed0::3:9"), 128, MustParseIPRange("fed0::1:7-fed0::3:9")},
+		{IPRange{}, 24, IPRange{}},
+	}
+	for _, tt := range tests {
+		if got := tt.r.AlignTo(tt.bits); got != tt.want {
+			t.Errorf("(%v).AlignTo(%d) = %v; want %v", tt.r, tt.bits, got, tt.want)
+		}
+	}
+}
+
 func TestIPRangeValid(t *testing.T) {
 	tests := []struct {
 		r    IPRange
@@ -612,6 +1360,10 @@ func TestIPRangePrefix(t *testing.T) {
 		{IPRange{mustIP("10.0.0.0"), mustIP("10.0.0.255")}, mustIPPrefix("10.0.0.0/24")},
 		{IPRange{mustIP("10.0.0.0"), mustIP("10.0.0.254")}, IPPrefix{}},
 		{IPRange{mustIP("fc00::"), AddrPrior(mustIP("fe00::"))}, mustIPPrefix("fc00::/7")},
+		{IPRange{mustIP("10.0.0.7"), mustIP("10.0.0.7")}, mustIPPrefix("10.0.0.7/32")},
+		{IPRange{mustIP("fed0::7"), mustIP("fed0::7")}, mustIPPrefix("fed0::7/128")},
+		{IPRange{mustIP("10.0.0.128"), mustIP("10.0.1.127")}, IPPrefix{}}, // power-of-two size, not aligned
+		{IPRange{}, IPPrefix{}},
 	}
 	for _, tt := range tests {
 		got, ok := tt.r.Prefix()
@@ -690,6 +1442,80 @@ func TestAddrNextPrior(t *testing.T) {
 	}
 }
 
+func TestAddrAddSub(t *testing.T) {
+	tests := []struct {
+		ip  IP
+		n   uint64
+		add IP
+		sub IP
+	}{
+		{mustIP("10.0.0.1"), 0, mustIP("10.0.0.1"), mustIP("10.0.0.1")},
+		{mustIP("10.0.0.1"), 1, mustIP("10.0.0.2"), mustIP("10.0.0.0")},
+		{mustIP("10.0.0.255"), 1, mustIP("10.0.1.0"), mustIP("10.0.0.254")},
+		{mustIP("10.0.255.255"), 257, mustIP("10.1.1.0"), mustIP("10.0.254.254")},
+		{mustIP("10.0.0.0"), 1 << 24, mustIP("11.0.0.0"), mustIP("9.0.0.0")},
+		{mustIP("255.255.255.255"), 1, IP{}, mustIP("255.255.255.254")},
+		{mustIP("0.0.0.0"), 1, mustIP("0.0.0.1"), IP{}},
+		{mustIP("0.0.0.0"), 1<<32 - 1, mustIP("255.255.255.255"), IP{}},
+		{mustIP("0.0.0.0"), 1 << 32, IP{}, IP{}},
+		{mustIP("::ffff:ffff"), 1, mustIP("::1:0:0"), mustIP("::ffff:fffe")},
+		{mustIP("::ffff:ffff:ffff:ffff"), 1, mustIP("0:0:0:1::"), mustIP("::ffff:ffff:ffff:fffe")},
+		{mustIP("0:0:0:1::"), 1, mustIP("0:0:0:1::1"), mustIP("::ffff:ffff:ffff:ffff")},
+		{mustIP("fe80::1%eth0"), 2, mustIP("fe80::3%eth0"), mustIP("fe7f:ffff:ffff:ffff:ffff:ffff:ffff:ffff%eth0")},
+		{mustIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe"), 2, IP{}, mustIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffc")},
+		{mustIP("::1"), 2, mustIP("::3"), IP{}},
+		{IP{}, 1, IP{}, IP{}},
+	}
+	for _, tt := range tests {
+		if got := AddrAdd(tt.ip, tt.n); got != tt.add {
+			t.Errorf("AddrAdd(%v, %d) = %v; want %v", tt.ip, tt.n, got, tt.add)
+		}
+		if got := AddrSub(tt.ip, tt.n); got != tt.sub {
+			t.Errorf("AddrSub(%v, %d) = %v; want %v", tt.ip, tt.n, got, tt.sub)
+		}
+	}
+	for _, tt := range nextPriorTests {
+		if got := AddrAdd(tt.ip, 1); got != tt.next {
+			t.Errorf("AddrAdd(%v, 1) = %v; want %v", tt.ip, got, tt.next)
+		}
+		if got := AddrSub(tt.ip, 1); got != tt.prior {
+			t.Errorf("AddrSub(%v, 1) = %v; want %v", tt.ip, got, tt.prior)
+		}
+	}
+}
+
+func TestAddrBitString(t *testing.T) {
+	tests := []struct {
+		ip   IP
+		want string
+	}{
+		{mustIP("0.0.0.0"), "00000000.00000000.00000000.00000000"},
+		{mustIP("10.1.128.255"), "00001010.00000001.10000000.11111111"},
+		{mustIP("255.255.255.255"), "11111111.11111111.11111111.11111111"},
+		{
+			mustIP("::"),
+			"0000000000000000:0000000000000000:0000000000000000:0000000000000000:" +
+				"0000000000000000:0000000000000000:0000000000000000:0000000000000000",
+		},
+		{
+			mustIP("2001:db8::8000:1%eth0"),
+			"0010000000000001:0000110110111000:0000000000000000:0000000000000000:" +
+				"0000000000000000:0000000000000000:1000000000000000:0000000000000001",
+		},
+		{
+			mustIP("::ffff:1.2.3.4"),
+			"0000000000000000:0000000000000000:0000000000000000:0000000000000000:" +
+				"0000000000000000:1111111111111111:0000000100000010:0000001100000100",
+		},
+		{IP{}, "invalid IP"},
+	}
+	for _, tt := range tests {
+		if got := AddrBitString(tt.ip); got != tt.want {
+			t.Errorf("AddrBitString(%v) = %q; want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
 func BenchmarkIPNextPrior(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		doNextPrior(b)
@@ -727,9 +1553,11 @@ var (
 	sinkIPPrefix      IPPrefix
 	sinkIPPrefixSlice []IPPrefix
 	sinkIPRange       IPRange
+	sinkIPRangeSlice  []IPRange
 	sinkIP16          [16]byte
 	sinkIP4           [4]byte
 	sinkBool          bool
+	sinkInt           int
 	sinkString        string
 	sinkBytes         []byte
 	sinkUDPAddr       = &net.UDPAddr{IP: make(net.IP, 0, 16)}
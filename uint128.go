@@ -6,6 +6,7 @@ package netipx
 
 import (
 	"encoding/binary"
+	"math/big"
 	"math/bits"
 	"net/netip"
 )
@@ -78,6 +79,46 @@ func (u uint128) addOne() uint128 {
 	return uint128{u.hi + carry, lo}
 }
 
+// add returns u + v, wrapping around on overflow.
+func (u uint128) add(v uint128) uint128 {
+	lo, carry := bits.Add64(u.lo, v.lo, 0)
+	return uint128{u.hi + v.hi + carry, lo}
+}
+
+// sub returns u - v, wrapping around on underflow.
+func (u uint128) sub(v uint128) uint128 {
+	lo, borrow := bits.Sub64(u.lo, v.lo, 0)
+	return uint128{u.hi - v.hi - borrow, lo}
+}
+
+// halve returns u / 2, rounded down.
+func (u uint128) halve() uint128 {
+	return uint128{u.hi >> 1, u.lo>>1 | u.hi<<63}
+}
+
+// less reports whether u < v.
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || (u.hi == v.hi && u.lo < v.lo)
+}
+
+// big returns u as a big.Int.
+func (u uint128) big() *big.Int {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], u.hi)
+	binary.BigEndian.PutUint64(b[8:], u.lo)
+	return new(big.Int).SetBytes(b[:])
+}
+
+// u128FromBig returns b as a uint128.
+// If b is negative or does not fit in 128 bits, ok is false.
+func u128FromBig(b *big.Int) (u uint128, ok bool) {
+	if b.Sign() < 0 || b.BitLen() > 128 {
+		return uint128{}, false
+	}
+	var a [16]byte
+	return u128From16(*(*[16]byte)(b.FillBytes(a[:]))), true
+}
+
 func u64CommonPrefixLen(a, b uint64) uint8 {
 	return uint8(bits.LeadingZeros64(a ^ b))
 }
@@ -5,6 +5,7 @@
 package netipx
 
 import (
+	"math/big"
 	"testing"
 )
 
@@ -44,6 +45,75 @@ func TestUint128AddSub(t *testing.T) {
 	}
 }
 
+func TestUint128Arith(t *testing.T) {
+	max := uint128{^uint64(0), ^uint64(0)}
+	tests := []struct {
+		a, b     uint128
+		sum      uint128
+		diff     uint128
+		lessThan bool
+	}{
+		{uint128{0, 0}, uint128{0, 0}, uint128{0, 0}, uint128{0, 0}, false},
+		{uint128{0, 5}, uint128{0, 3}, uint128{0, 8}, uint128{0, 2}, false},
+		{uint128{0, 3}, uint128{0, 5}, uint128{0, 8}, max.subOne(), true},
+		{uint128{0, ^uint64(0)}, uint128{0, 1}, uint128{1, 0}, uint128{0, ^uint64(0) - 1}, false},
+		{uint128{1, 0}, uint128{0, 1}, uint128{1, 1}, uint128{0, ^uint64(0)}, false},
+		{uint128{1, 0}, uint128{1, 1}, uint128{2, 1}, max, true},
+		{max, uint128{0, 1}, uint128{0, 0}, max.subOne(), false},
+	}
+	for _, tt := range tests {
+		if got := tt.a.add(tt.b); got != tt.sum {
+			t.Errorf("%v + %v = %v; want %v", tt.a, tt.b, got, tt.sum)
+		}
+		if got := tt.a.sub(tt.b); got != tt.diff {
+			t.Errorf("%v - %v = %v; want %v", tt.a, tt.b, got, tt.diff)
+		}
+		if got := tt.a.less(tt.b); got != tt.lessThan {
+			t.Errorf("%v < %v = %v; want %v", tt.a, tt.b, got, tt.lessThan)
+		}
+	}
+}
+
+func TestUint128Halve(t *testing.T) {
+	tests := []struct {
+		in, want uint128
+	}{
+		{uint128{0, 0}, uint128{0, 0}},
+		{uint128{0, 1}, uint128{0, 0}},
+		{uint128{0, 5}, uint128{0, 2}},
+		{uint128{1, 0}, uint128{0, 1 << 63}},
+		{uint128{3, 1}, uint128{1, 1 << 63}},
+		{uint128{^uint64(0), ^uint64(0)}, uint128{^uint64(0) >> 1, ^uint64(0)}},
+	}
+	for _, tt := range tests {
+		if got := tt.in.halve(); got != tt.want {
+			t.Errorf("%v.halve() = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUint128Big(t *testing.T) {
+	for _, u := range []uint128{
+		{0, 0},
+		{0, 1},
+		{1, 0},
+		{0x0123456789abcdef, 0xfedcba9876543210},
+		{^uint64(0), ^uint64(0)},
+	} {
+		b := u.big()
+		got, ok := u128FromBig(b)
+		if !ok || got != u {
+			t.Errorf("u128FromBig(%v.big()) = %v, %v; want %v, true", u, got, ok, u)
+		}
+	}
+	tooBig := new(big.Int).Lsh(big.NewInt(1), 128)
+	for _, b := range []*big.Int{big.NewInt(-1), tooBig} {
+		if _, ok := u128FromBig(b); ok {
+			t.Errorf("u128FromBig(%v) ok; want not ok", b)
+		}
+	}
+}
+
 func TestBitsSetFrom(t *testing.T) {
 	tests := []struct {
 		bit  uint8